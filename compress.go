@@ -18,9 +18,10 @@ func (w gzipResponseWriter) Write(b []byte) (int, error) {
 }
 
 // Gzip is a gzip handler
+// Downloads are never compressed, as it would break Content-Length and Range requests
 func Gzip(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") || strings.HasPrefix(r.URL.Path, "/download/") {
 			handler.ServeHTTP(w, r)
 			return
 		}
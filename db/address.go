@@ -0,0 +1,59 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Address is a payment address handed out by /bitcoin
+type Address struct {
+	Address string    `bson:"address"`
+	Secret  string    `bson:"secret"` // identifies the session which asked for the address
+	Created time.Time `bson:"created"`
+	Plan    string    `bson:"plan,omitempty"`   // the plan chosen when asking for the address
+	Renews  string    `bson:"renews,omitempty"` // the permanent token a payment renews, or a new one is minted
+
+	// Quote is the prices in BTC of the plans, by name, when the address was handed out at Quoted.
+	// Payments made while the quote is valid are checked against it, whatever the exchange rates since.
+	Quote  map[string]float64 `bson:"quote,omitempty"`
+	Quoted time.Time          `bson:"quoted,omitempty"`
+
+	TxID  string `bson:"tx,omitempty"`    // the transaction paying to this address
+	Token string `bson:"token,omitempty"` // the permanent token minted for it
+}
+
+// StoreAddress stores a new payment address
+func (db *DB) StoreAddress(ctx context.Context, address *Address) error {
+	address.Created = time.Now()
+	_, err := db.addresses().InsertOne(ctx, address)
+	return err
+}
+
+// FindAddress returns the first of the addresses which was handed out, or nil
+func (db *DB) FindAddress(ctx context.Context, addresses ...string) (*Address, error) {
+	var address Address
+	err := db.addresses().FindOne(ctx, bson.M{"address": bson.M{"$in": addresses}}).Decode(&address)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &address, nil
+}
+
+// AddressPaid records the transaction paying to an address, and the token once it is minted
+func (db *DB) AddressPaid(ctx context.Context, address string, txid string, token string) error {
+	update := bson.M{"tx": txid}
+	if token != "" {
+		update["token"] = token
+	}
+	return updated(db.addresses().UpdateOne(ctx, bson.M{"address": address}, bson.M{"$set": update}))
+}
+
+func (db *DB) addresses() *mongo.Collection {
+	return db.collection(addrCollectionName)
+}
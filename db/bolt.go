@@ -0,0 +1,630 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// DefaultBoltPath is the default location of the embedded database
+const DefaultBoltPath = "ezcp.db"
+
+var (
+	tokensBucket = []byte(tokensCollectionName)
+	txBucket     = []byte(txCollectionName)
+	certsBucket  = []byte(certsCollectionName)
+	locksBucket  = []byte(locksCollectionName)
+	addrBucket   = []byte(addrCollectionName)
+	delBucket    = []byte(delCollectionName)
+)
+
+// Bolt is the embedded Store, for single node installs.
+// Documents are stored in BSON like in MongoDB, keyed by their unique field.
+// Expired documents are removed by DueDeletions, there are no TTL indexes.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// lock is a stored job lock
+type lock struct {
+	Name    string    `bson:"name"`
+	Owner   string    `bson:"owner"`
+	Expires time.Time `bson:"expires"`
+}
+
+// NewBolt opens the embedded database at path, it is created if needed
+func NewBolt(path string) (*Bolt, error) {
+	database, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = database.Update(func(btx *bolt.Tx) error {
+		for _, name := range [][]byte{tokensBucket, txBucket, certsBucket, locksBucket, addrBucket, delBucket} {
+			if _, err := btx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		database.Close()
+		return nil, err
+	}
+	log.Print("Opened ", path)
+	return &Bolt{database}, nil
+}
+
+// CreateToken stores a new token, which expires after lifetime
+func (b *Bolt) CreateToken(ctx context.Context, token string, lifetime time.Duration) error {
+	now := time.Now()
+	expiresAt := now.Add(lifetime)
+	return b.insertToken(&Token{
+		Token:     token,
+		Created:   now,
+		Permanent: false,
+		ExpiresAt: &expiresAt,
+	})
+}
+
+// CreateDurableToken stores a new permanent token bought under plan, until expires
+func (b *Bolt) CreateDurableToken(ctx context.Context, token string, creator string, plan string, expires time.Time) error {
+	expiresAt := expires.Add(ExpiredRetention)
+	return b.insertToken(&Token{
+		Token:     token,
+		Created:   time.Now(),
+		Permanent: true,
+		Creator:   creator,
+		Plan:      plan,
+		Expires:   &expires,
+		ExpiresAt: &expiresAt,
+	})
+}
+
+// insertToken stores a new token, and schedules the deletion of its files
+func (b *Bolt) insertToken(tok *Token) error {
+	return b.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(tokensBucket)
+		if bucket.Get([]byte(tok.Token)) != nil {
+			return errDuplicate
+		}
+		if err := put(bucket, tok.Token, tok); err != nil {
+			return err
+		}
+		return put(btx.Bucket(delBucket), tok.Token, &deletion{tok.Token, *tok.ExpiresAt})
+	})
+}
+
+// GetToken returns a token or nil if not found
+func (b *Bolt) GetToken(ctx context.Context, token string) (*Token, error) {
+	var tok Token
+	found, err := b.find(tokensBucket, token, &tok)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &tok, nil
+}
+
+// TokenExists checks if a token exists
+func (b *Bolt) TokenExists(ctx context.Context, token string, checkNoUpload bool) (bool, error) {
+	tok, err := b.GetToken(ctx, token)
+	if err != nil || tok == nil {
+		return false, err
+	}
+	return !checkNoUpload || tok.Uploaded == nil, nil
+}
+
+// TokenUploaded is called once a file has been uploaded
+func (b *Bolt) TokenUploaded(ctx context.Context, token string, length int64, sha256 string, envelope string, timestamp time.Time) error {
+	return b.updateToken(token, func(tok *Token) {
+		tok.Length = length
+		tok.SHA256 = sha256
+		tok.Envelope = envelope
+		tok.Uploaded = &timestamp
+		tok.Failed = nil
+	})
+}
+
+// TokenUploadFailed is called when an upload is interrupted, and its partial file discarded
+func (b *Bolt) TokenUploadFailed(ctx context.Context, token string, timestamp time.Time) error {
+	return b.updateToken(token, func(tok *Token) {
+		tok.Failed = &timestamp
+	})
+}
+
+// TokenUploadCreated is called when a resumable upload of length bytes starts
+func (b *Bolt) TokenUploadCreated(ctx context.Context, token string, length int64) error {
+	return b.updateToken(token, func(tok *Token) {
+		tok.UploadLength = length
+	})
+}
+
+// TokenDownloaded is called once a file has been downloaded
+func (b *Bolt) TokenDownloaded(ctx context.Context, token *Token, timestamp time.Time) error {
+	return b.updateToken(token.Token, func(tok *Token) {
+		tok.Downloaded = &timestamp
+		tok.Downloads++
+	})
+}
+
+// TokenCleared is called when the file of a permanent token is deleted, so it can be uploaded again
+func (b *Bolt) TokenCleared(ctx context.Context, token string) error {
+	return b.updateToken(token, clearUpload)
+}
+
+// ExtendToken moves the expiry of a permanent token by duration, starting from now if it has already expired,
+// and switches it to plan unless empty. It returns the new expiry.
+func (b *Bolt) ExtendToken(ctx context.Context, token string, plan string, duration time.Duration) (time.Time, error) {
+	var expires time.Time
+	err := b.updateToken(token, func(tok *Token) {
+		expires = extendedExpiry(tok.Expires, duration)
+		expiresAt := expires.Add(ExpiredRetention)
+		tok.Expires = &expires
+		tok.ExpiresAt = &expiresAt
+		if plan != "" {
+			tok.Plan = plan
+		}
+	})
+	return expires, err
+}
+
+// TokenExpiryComputed stores the expiry of a permanent token created before expiries were stored
+func (b *Bolt) TokenExpiryComputed(ctx context.Context, token string, expires time.Time) error {
+	expiresAt := expires.Add(ExpiredRetention)
+	return b.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(tokensBucket)
+		var tok Token
+		found, err := get(bucket, token, &tok)
+		if err != nil || !found || tok.Expires != nil {
+			return err
+		}
+		tok.Expires = &expires
+		tok.ExpiresAt = &expiresAt
+		if err = put(bucket, token, &tok); err != nil {
+			return err
+		}
+		return put(btx.Bucket(delBucket), token, &deletion{token, expiresAt})
+	})
+}
+
+// ListTokens returns every token
+func (b *Bolt) ListTokens(ctx context.Context) ([]Token, error) {
+	var tokens []Token
+	err := b.db.View(func(btx *bolt.Tx) error {
+		return btx.Bucket(tokensBucket).ForEach(func(key []byte, data []byte) error {
+			var tok Token
+			if err := bson.Unmarshal(data, &tok); err != nil {
+				return err
+			}
+			tokens = append(tokens, tok)
+			return nil
+		})
+	})
+	return tokens, err
+}
+
+// RemoveToken removes a token
+func (b *Bolt) RemoveToken(ctx context.Context, token string) error {
+	return b.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(tokensBucket)
+		if bucket.Get([]byte(token)) == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete([]byte(token))
+	})
+}
+
+// RemoveExpiredTokens removes the transient tokens older than lifetime and returns them
+func (b *Bolt) RemoveExpiredTokens(ctx context.Context, lifetime time.Duration) ([]string, error) {
+	before := time.Now().Add(-lifetime)
+
+	var result []string
+	err := b.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(tokensBucket)
+		err := bucket.ForEach(func(key []byte, data []byte) error {
+			var tok Token
+			if err := bson.Unmarshal(data, &tok); err != nil {
+				return err
+			}
+			if !tok.Permanent && tok.Created.Before(before) {
+				result = append(result, tok.Token)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// a bucket can't be modified while iterating over it
+		for _, each := range result {
+			if err = bucket.Delete([]byte(each)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// RemoveExpiredUploads forgets the files of permanent tokens of plan uploaded before the retention period
+// and returns the tokens, whose files must be deleted. Tokens without a plan are included if withoutPlan is true.
+func (b *Bolt) RemoveExpiredUploads(ctx context.Context, plan string, withoutPlan bool, retention time.Duration) ([]string, error) {
+	before := time.Now().Add(-retention)
+
+	var result []Token
+	err := b.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(tokensBucket)
+		err := bucket.ForEach(func(key []byte, data []byte) error {
+			var tok Token
+			if err := bson.Unmarshal(data, &tok); err != nil {
+				return err
+			}
+			if tok.Permanent && tok.Uploaded != nil && tok.Uploaded.Before(before) &&
+				(tok.Plan == plan || withoutPlan && tok.Plan == "") {
+				result = append(result, tok)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i := range result {
+			clearUpload(&result[i])
+			if err = put(bucket, result[i].Token, &result[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []string
+	for _, each := range result {
+		tokens = append(tokens, each.Token)
+	}
+	return tokens, nil
+}
+
+// StoreTransaction stores a transaction
+func (b *Bolt) StoreTransaction(ctx context.Context, tx *Transaction) error {
+	return b.insert(txBucket, tx.ID, tx)
+}
+
+// RemoveTransaction forgets a cached transaction, which didn't pay for anything after all
+func (b *Bolt) RemoveTransaction(ctx context.Context, txid string) error {
+	return b.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(txBucket)
+		if bucket.Get([]byte(txid)) == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete([]byte(txid))
+	})
+}
+
+// LoadTransaction loads a transaction, or returns nil if not found
+func (b *Bolt) LoadTransaction(ctx context.Context, txid string) (*Transaction, error) {
+	var tx Transaction
+	found, err := b.find(txBucket, txid, &tx)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &tx, nil
+}
+
+// UnsettledTransactions returns the transactions with a token and less than depth confirmations
+func (b *Bolt) UnsettledTransactions(ctx context.Context, depth int) ([]Transaction, error) {
+	var transactions []Transaction
+	err := b.db.View(func(btx *bolt.Tx) error {
+		return btx.Bucket(txBucket).ForEach(func(key []byte, data []byte) error {
+			var tx Transaction
+			if err := bson.Unmarshal(data, &tx); err != nil {
+				return err
+			}
+			if tx.Confirmations < depth && tx.Token != nil && !tx.Revoked {
+				transactions = append(transactions, tx)
+			}
+			return nil
+		})
+	})
+	return transactions, err
+}
+
+// TransactionConfirmed updates the confirmations of a stored transaction
+func (b *Bolt) TransactionConfirmed(ctx context.Context, txid string, confirmations int) error {
+	return b.update(txBucket, txid, &Transaction{}, func(doc interface{}) {
+		tx := doc.(*Transaction)
+		tx.Confirmations = confirmations
+		tx.Pending = confirmations == 0
+	})
+}
+
+// TransactionMissed updates how many times in a row the provider didn't find a stored transaction
+func (b *Bolt) TransactionMissed(ctx context.Context, txid string, missed int) error {
+	return b.update(txBucket, txid, &Transaction{}, func(doc interface{}) {
+		doc.(*Transaction).Missed = missed
+	})
+}
+
+// RevokeTransaction marks a stored transaction revoked, and removes its token,
+// or takes back the extension for a renewal
+func (b *Bolt) RevokeTransaction(ctx context.Context, tx *Transaction) error {
+	err := b.update(txBucket, tx.ID, &Transaction{}, func(doc interface{}) {
+		doc.(*Transaction).Revoked = true
+	})
+	if err != nil {
+		return err
+	}
+	if tx.Token == nil {
+		return nil
+	}
+	if tx.Extension > 0 {
+		_, err = b.ExtendToken(ctx, *tx.Token, "", -tx.Extension)
+	} else {
+		err = b.RemoveToken(ctx, *tx.Token)
+	}
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// StoreAddress stores a new payment address
+func (b *Bolt) StoreAddress(ctx context.Context, address *Address) error {
+	address.Created = time.Now()
+	return b.insert(addrBucket, address.Address, address)
+}
+
+// FindAddress returns the first of the addresses which was handed out, or nil
+func (b *Bolt) FindAddress(ctx context.Context, addresses ...string) (*Address, error) {
+	for _, each := range addresses {
+		var address Address
+		found, err := b.find(addrBucket, each, &address)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			return &address, nil
+		}
+	}
+	return nil, nil
+}
+
+// AddressPaid records the transaction paying to an address, and the token once it is minted
+func (b *Bolt) AddressPaid(ctx context.Context, address string, txid string, token string) error {
+	return b.update(addrBucket, address, &Address{}, func(doc interface{}) {
+		each := doc.(*Address)
+		each.TxID = txid
+		if token != "" {
+			each.Token = token
+		}
+	})
+}
+
+// AcquireLock acquires or renews the named lock for owner, until ttl expires.
+// It returns false if another owner holds the lock.
+func (b *Bolt) AcquireLock(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error) {
+	acquired := false
+	err := b.db.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(locksBucket)
+		now := time.Now()
+
+		var current lock
+		found, err := get(bucket, name, &current)
+		if err != nil {
+			return err
+		}
+		if found && current.Owner != owner && current.Expires.After(now) {
+			return nil
+		}
+		acquired = true
+		return put(bucket, name, &lock{name, owner, now.Add(ttl)})
+	})
+	return acquired, err
+}
+
+// DueDeletions removes the expired tokens and transactions, like MongoDB's TTL indexes,
+// and returns the tokens whose files can be deleted because their document is gone.
+// The deletions of tokens which still exist, because they were renewed, are postponed.
+func (b *Bolt) DueDeletions(ctx context.Context) ([]string, error) {
+	now := time.Now()
+	var result []string
+	err := b.db.Update(func(btx *bolt.Tx) error {
+		if err := expire(btx.Bucket(tokensBucket), now); err != nil {
+			return err
+		}
+		if err := expire(btx.Bucket(txBucket), now); err != nil {
+			return err
+		}
+
+		bucket := btx.Bucket(delBucket)
+		var postpone []deletion
+		err := bucket.ForEach(func(key []byte, data []byte) error {
+			var each deletion
+			if err := bson.Unmarshal(data, &each); err != nil {
+				return err
+			}
+			if each.Due.After(now) {
+				return nil
+			}
+			var tok Token
+			found, err := get(btx.Bucket(tokensBucket), each.Token, &tok)
+			if err != nil {
+				return err
+			}
+			if found {
+				postpone = append(postpone, deletion{each.Token, postponed(&tok)})
+			} else {
+				result = append(result, each.Token)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i := range postpone {
+			if err = put(bucket, postpone[i].Token, &postpone[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DeletionDone is called once the files of a token returned by DueDeletions are deleted
+func (b *Bolt) DeletionDone(ctx context.Context, token string) error {
+	return b.db.Update(func(btx *bolt.Tx) error {
+		return btx.Bucket(delBucket).Delete([]byte(token))
+	})
+}
+
+// expire removes the documents of bucket whose expiresAt is before now
+func expire(bucket *bolt.Bucket, now time.Time) error {
+	var expired [][]byte
+	err := bucket.ForEach(func(key []byte, data []byte) error {
+		var expiry struct {
+			ExpiresAt *time.Time `bson:"expiresAt"`
+		}
+		if err := bson.Unmarshal(data, &expiry); err != nil {
+			return err
+		}
+		if expiry.ExpiresAt != nil && expiry.ExpiresAt.Before(now) {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range expired {
+		if err = bucket.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns a certificate data for the specified key.
+// If there's no such key, Get returns ErrCacheMiss.
+func (b *Bolt) Get(ctx context.Context, key string) ([]byte, error) {
+	var result kv
+	found, err := b.find(certsBucket, key, &result)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, autocert.ErrCacheMiss
+	}
+	return result.Value, nil
+}
+
+// Put stores the data in the cache under the specified key.
+func (b *Bolt) Put(ctx context.Context, key string, data []byte) error {
+	return b.db.Update(func(btx *bolt.Tx) error {
+		return put(btx.Bucket(certsBucket), key, &kv{key, data})
+	})
+}
+
+// Delete removes a certificate data from the cache under the specified key.
+// If there's no such key in the cache, Delete returns nil.
+func (b *Bolt) Delete(ctx context.Context, key string) error {
+	return b.db.Update(func(btx *bolt.Tx) error {
+		return btx.Bucket(certsBucket).Delete([]byte(key))
+	})
+}
+
+// Ping checks the database is open
+func (b *Bolt) Ping(ctx context.Context) error {
+	return b.db.View(func(btx *bolt.Tx) error {
+		return nil
+	})
+}
+
+// Close will definitely close the database
+func (b *Bolt) Close() {
+	b.db.Close()
+	log.Print("DB closed")
+}
+
+// insert stores a new document under key, it returns errDuplicate if there's already one
+func (b *Bolt) insert(bucket []byte, key string, doc interface{}) error {
+	return b.db.Update(func(btx *bolt.Tx) error {
+		each := btx.Bucket(bucket)
+		if each.Get([]byte(key)) != nil {
+			return errDuplicate
+		}
+		return put(each, key, doc)
+	})
+}
+
+// find decodes the document under key into result, and returns false if there is none
+func (b *Bolt) find(bucket []byte, key string, result interface{}) (bool, error) {
+	found := false
+	err := b.db.View(func(btx *bolt.Tx) error {
+		var err error
+		found, err = get(btx.Bucket(bucket), key, result)
+		return err
+	})
+	return found, err
+}
+
+// update decodes the document under key into doc, applies change and stores it back.
+// It returns ErrNotFound if there's no document.
+func (b *Bolt) update(bucket []byte, key string, doc interface{}, change func(interface{})) error {
+	return b.db.Update(func(btx *bolt.Tx) error {
+		each := btx.Bucket(bucket)
+		found, err := get(each, key, doc)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrNotFound
+		}
+		change(doc)
+		return put(each, key, doc)
+	})
+}
+
+// updateToken applies change to a stored token
+func (b *Bolt) updateToken(token string, change func(*Token)) error {
+	return b.update(tokensBucket, token, &Token{}, func(doc interface{}) {
+		change(doc.(*Token))
+	})
+}
+
+func get(bucket *bolt.Bucket, key string, result interface{}) (bool, error) {
+	data := bucket.Get([]byte(key))
+	if data == nil {
+		return false, nil
+	}
+	return true, bson.Unmarshal(data, result)
+}
+
+func put(bucket *bolt.Bucket, key string, doc interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), data)
+}
+
+// clearUpload forgets the file of a token, like TokenCleared
+func clearUpload(tok *Token) {
+	tok.Length = 0
+	tok.SHA256 = ""
+	tok.Envelope = ""
+	tok.Uploaded = nil
+	tok.UploadLength = 0
+	tok.Downloads = 0
+	tok.Failed = nil
+}
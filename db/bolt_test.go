@@ -0,0 +1,374 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func newTestBolt(t *testing.T) *Bolt {
+	b, err := NewBolt(filepath.Join(t.TempDir(), "ezcp.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Close)
+	return b
+}
+
+// Bolt must implement Store
+var _ Store = &Bolt{}
+
+func TestBoltTokens(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	if err := b.CreateToken(ctx, "transient", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.CreateToken(ctx, "transient", time.Hour); err == nil {
+		t.Error("CreateToken accepted a duplicate")
+	}
+	tok, err := b.GetToken(ctx, "transient")
+	if err != nil || tok == nil {
+		t.Fatalf("GetToken = %v, %v", tok, err)
+	}
+	if tok.Permanent || tok.ExpiresAt == nil || tok.Uploaded != nil {
+		t.Errorf("new token = %+v", tok)
+	}
+	if tok, err = b.GetToken(ctx, "missing"); tok != nil || err != nil {
+		t.Errorf("GetToken of a missing token = %v, %v", tok, err)
+	}
+
+	if exists, _ := b.TokenExists(ctx, "transient", true); !exists {
+		t.Error("TokenExists = false before upload")
+	}
+	if err = b.TokenUploadFailed(ctx, "transient", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.TokenUploaded(ctx, "transient", 5, "abcd", "v1/pbkdf2-sha256", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := b.TokenExists(ctx, "transient", true); exists {
+		t.Error("TokenExists without upload = true after upload")
+	}
+	if exists, _ := b.TokenExists(ctx, "transient", false); !exists {
+		t.Error("TokenExists = false after upload")
+	}
+	tok, _ = b.GetToken(ctx, "transient")
+	if tok.Length != 5 || tok.SHA256 != "abcd" || tok.Envelope != "v1/pbkdf2-sha256" || tok.Uploaded == nil || tok.Failed != nil {
+		t.Errorf("uploaded token = %+v", tok)
+	}
+
+	if err = b.TokenDownloaded(ctx, tok, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	tok, _ = b.GetToken(ctx, "transient")
+	if tok.Downloads != 1 || tok.Downloaded == nil {
+		t.Errorf("downloaded token = %+v", tok)
+	}
+
+	if err = b.TokenCleared(ctx, "transient"); err != nil {
+		t.Fatal(err)
+	}
+	tok, _ = b.GetToken(ctx, "transient")
+	if tok.Uploaded != nil || tok.Length != 0 || tok.SHA256 != "" || tok.Downloads != 0 {
+		t.Errorf("cleared token = %+v", tok)
+	}
+
+	if err = b.TokenUploaded(ctx, "missing", 5, "", "", time.Now()); err != ErrNotFound {
+		t.Errorf("TokenUploaded of a missing token = %v, want ErrNotFound", err)
+	}
+	if err = b.RemoveToken(ctx, "transient"); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.RemoveToken(ctx, "transient"); err != ErrNotFound {
+		t.Errorf("second RemoveToken = %v, want ErrNotFound", err)
+	}
+}
+
+func TestBoltExtendToken(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	expires := time.Now().Add(24 * time.Hour)
+	if err := b.CreateDurableToken(ctx, "durable", "creator", "basic", expires); err != nil {
+		t.Fatal(err)
+	}
+	extended, err := b.ExtendToken(ctx, "durable", "pro", 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !closeTo(extended, expires.Add(48*time.Hour)) {
+		t.Errorf("ExtendToken = %v, want %v", extended, expires.Add(48*time.Hour))
+	}
+	tok, _ := b.GetToken(ctx, "durable")
+	if !tok.Permanent || tok.Plan != "pro" || tok.Creator != "creator" || !closeTo(*tok.Expires, extended) ||
+		!closeTo(*tok.ExpiresAt, extended.Add(ExpiredRetention)) {
+		t.Errorf("extended token = %+v", tok)
+	}
+
+	// an expired token is extended from now
+	if err = b.CreateDurableToken(ctx, "expired", "creator", "basic", time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	extended, _ = b.ExtendToken(ctx, "expired", "", time.Hour)
+	if !closeTo(extended, time.Now().Add(time.Hour)) {
+		t.Errorf("ExtendToken of an expired token = %v", extended)
+	}
+	if tok, _ = b.GetToken(ctx, "expired"); tok.Plan != "basic" {
+		t.Errorf("plan = %s, want it unchanged", tok.Plan)
+	}
+
+	if _, err = b.ExtendToken(ctx, "missing", "", time.Hour); err != ErrNotFound {
+		t.Errorf("ExtendToken of a missing token = %v, want ErrNotFound", err)
+	}
+}
+
+func TestBoltRemoveExpired(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	b.CreateToken(ctx, "recent", time.Hour)
+	b.CreateDurableToken(ctx, "durable", "", "basic", time.Now().Add(time.Hour))
+	removed, err := b.RemoveExpiredTokens(ctx, -time.Minute) // created before a minute from now
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != "recent" {
+		t.Errorf("RemoveExpiredTokens = %v", removed)
+	}
+
+	b.TokenUploaded(ctx, "durable", 5, "", "", time.Now().Add(-2*time.Hour))
+	b.CreateDurableToken(ctx, "other", "", "pro", time.Now().Add(time.Hour))
+	b.TokenUploaded(ctx, "other", 5, "", "", time.Now().Add(-2*time.Hour))
+	cleared, err := b.RemoveExpiredUploads(ctx, "basic", false, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cleared) != 1 || cleared[0] != "durable" {
+		t.Errorf("RemoveExpiredUploads = %v", cleared)
+	}
+	if tok, _ := b.GetToken(ctx, "durable"); tok.Uploaded != nil {
+		t.Error("the upload wasn't forgotten")
+	}
+	if tok, _ := b.GetToken(ctx, "other"); tok.Uploaded == nil {
+		t.Error("the upload of another plan was forgotten")
+	}
+}
+
+func TestBoltTransactions(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	token := "durable"
+	tx := &Transaction{ID: "tx1", Confirmations: 1, Token: &token, Plan: "basic"}
+	if err := b.StoreTransaction(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.StoreTransaction(ctx, tx); err == nil {
+		t.Error("StoreTransaction accepted a duplicate")
+	}
+	b.StoreTransaction(ctx, &Transaction{ID: "settled", Confirmations: 6, Token: &token})
+	b.StoreTransaction(ctx, &Transaction{ID: "unpaid", Confirmations: 0})
+
+	loaded, err := b.LoadTransaction(ctx, "tx1")
+	if err != nil || loaded == nil || *loaded.Token != token || loaded.Plan != "basic" {
+		t.Fatalf("LoadTransaction = %+v, %v", loaded, err)
+	}
+	if loaded, err = b.LoadTransaction(ctx, "missing"); loaded != nil || err != nil {
+		t.Errorf("LoadTransaction of a missing transaction = %v, %v", loaded, err)
+	}
+
+	unsettled, err := b.UnsettledTransactions(ctx, 6)
+	if err != nil || len(unsettled) != 1 || unsettled[0].ID != "tx1" {
+		t.Errorf("UnsettledTransactions = %v, %v", unsettled, err)
+	}
+
+	if err = b.TransactionConfirmed(ctx, "tx1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.TransactionMissed(ctx, "tx1", 2); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _ = b.LoadTransaction(ctx, "tx1")
+	if loaded.Confirmations != 0 || !loaded.Pending || loaded.Missed != 2 {
+		t.Errorf("updated transaction = %+v", loaded)
+	}
+	if err = b.TransactionConfirmed(ctx, "missing", 1); err != ErrNotFound {
+		t.Errorf("TransactionConfirmed of a missing transaction = %v, want ErrNotFound", err)
+	}
+
+	if err = b.RemoveTransaction(ctx, "unpaid"); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.RemoveTransaction(ctx, "unpaid"); err != ErrNotFound {
+		t.Errorf("second RemoveTransaction = %v, want ErrNotFound", err)
+	}
+}
+
+func TestBoltRevokeTransaction(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	minted, renewed := "minted", "renewed"
+	expires := time.Now().Add(24 * time.Hour)
+	b.CreateDurableToken(ctx, minted, "", "basic", expires)
+	b.CreateDurableToken(ctx, renewed, "", "basic", expires)
+	b.ExtendToken(ctx, renewed, "", time.Hour)
+
+	purchase := &Transaction{ID: "purchase", Token: &minted}
+	renewal := &Transaction{ID: "renewal", Token: &renewed, Extension: time.Hour}
+	b.StoreTransaction(ctx, purchase)
+	b.StoreTransaction(ctx, renewal)
+
+	// a purchase loses its token, a renewal its extension
+	if err := b.RevokeTransaction(ctx, purchase); err != nil {
+		t.Fatal(err)
+	}
+	if tok, _ := b.GetToken(ctx, minted); tok != nil {
+		t.Error("the token of a revoked purchase wasn't removed")
+	}
+	if err := b.RevokeTransaction(ctx, renewal); err != nil {
+		t.Fatal(err)
+	}
+	if tok, _ := b.GetToken(ctx, renewed); tok == nil || !closeTo(*tok.Expires, expires) {
+		t.Errorf("the renewal wasn't taken back: %+v", tok)
+	}
+	if loaded, _ := b.LoadTransaction(ctx, "purchase"); !loaded.Revoked {
+		t.Error("the transaction wasn't marked revoked")
+	}
+	if unsettled, _ := b.UnsettledTransactions(ctx, 6); len(unsettled) != 0 {
+		t.Errorf("revoked transactions are unsettled: %v", unsettled)
+	}
+
+	// revoking again is harmless once the token is gone
+	if err := b.RevokeTransaction(ctx, purchase); err != nil {
+		t.Errorf("second RevokeTransaction = %v", err)
+	}
+}
+
+func TestBoltAddresses(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	if err := b.StoreAddress(ctx, &Address{Address: "addr1", Secret: "secret", Plan: "basic"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.StoreAddress(ctx, &Address{Address: "addr1"}); err == nil {
+		t.Error("StoreAddress accepted a duplicate")
+	}
+	address, err := b.FindAddress(ctx, "other", "addr1")
+	if err != nil || address == nil || address.Secret != "secret" || address.Plan != "basic" || address.Created.IsZero() {
+		t.Fatalf("FindAddress = %+v, %v", address, err)
+	}
+	if address, err = b.FindAddress(ctx, "other"); address != nil || err != nil {
+		t.Errorf("FindAddress of unknown addresses = %v, %v", address, err)
+	}
+
+	if err = b.AddressPaid(ctx, "addr1", "tx1", ""); err != nil {
+		t.Fatal(err)
+	}
+	b.AddressPaid(ctx, "addr1", "tx1", "minted")
+	if address, _ = b.FindAddress(ctx, "addr1"); address.TxID != "tx1" || address.Token != "minted" {
+		t.Errorf("paid address = %+v", address)
+	}
+	if err = b.AddressPaid(ctx, "other", "tx1", ""); err != ErrNotFound {
+		t.Errorf("AddressPaid of an unknown address = %v, want ErrNotFound", err)
+	}
+}
+
+func TestBoltAcquireLock(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	if acquired, err := b.AcquireLock(ctx, "sweep", "one", time.Hour); !acquired || err != nil {
+		t.Fatalf("AcquireLock = %v, %v", acquired, err)
+	}
+	if acquired, _ := b.AcquireLock(ctx, "sweep", "two", time.Hour); acquired {
+		t.Error("another owner acquired a held lock")
+	}
+	if acquired, _ := b.AcquireLock(ctx, "sweep", "one", -time.Second); !acquired {
+		t.Error("the owner couldn't renew its lock")
+	}
+	if acquired, _ := b.AcquireLock(ctx, "sweep", "two", time.Hour); !acquired {
+		t.Error("another owner couldn't acquire an expired lock")
+	}
+}
+
+func TestBoltDueDeletions(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	b.CreateToken(ctx, "expired", -time.Hour)
+	b.CreateToken(ctx, "alive", time.Hour)
+	// renewed after its deletion was due
+	b.CreateDurableToken(ctx, "renewed", "", "basic", time.Now().Add(-ExpiredRetention-time.Hour))
+	b.ExtendToken(ctx, "renewed", "", 24*time.Hour)
+	b.StoreTransaction(ctx, &Transaction{ID: "old", ExpiresAt: timePtr(time.Now().Add(-time.Hour))})
+
+	due, err := b.DueDeletions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(due)
+	if len(due) != 1 || due[0] != "expired" {
+		t.Errorf("DueDeletions = %v", due)
+	}
+	if tok, _ := b.GetToken(ctx, "expired"); tok != nil {
+		t.Error("the expired token wasn't removed")
+	}
+	if tx, _ := b.LoadTransaction(ctx, "old"); tx != nil {
+		t.Error("the expired transaction wasn't removed")
+	}
+
+	// until done, the deletion is returned again
+	if due, _ = b.DueDeletions(ctx); len(due) != 1 {
+		t.Errorf("DueDeletions before DeletionDone = %v", due)
+	}
+	if err = b.DeletionDone(ctx, "expired"); err != nil {
+		t.Fatal(err)
+	}
+	if due, _ = b.DueDeletions(ctx); len(due) != 0 {
+		t.Errorf("DueDeletions after DeletionDone = %v", due)
+	}
+}
+
+func TestBoltCertificates(t *testing.T) {
+	ctx := context.Background()
+	b := newTestBolt(t)
+
+	if _, err := b.Get(ctx, "example.com"); err != autocert.ErrCacheMiss {
+		t.Errorf("Get = %v, want ErrCacheMiss", err)
+	}
+	if err := b.Put(ctx, "example.com", []byte("pem")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := b.Get(ctx, "example.com"); err != nil || string(data) != "pem" {
+		t.Errorf("Get = %q, %v", data, err)
+	}
+	if err := b.Delete(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Get(ctx, "example.com"); err != autocert.ErrCacheMiss {
+		t.Errorf("Get after Delete = %v, want ErrCacheMiss", err)
+	}
+	if err := b.Delete(ctx, "example.com"); err != nil {
+		t.Errorf("second Delete = %v", err)
+	}
+	if err := b.Ping(ctx); err != nil {
+		t.Errorf("Ping = %v", err)
+	}
+}
+
+// closeTo compares times stored in BSON, which keeps milliseconds
+func closeTo(a time.Time, b time.Time) bool {
+	return a.Sub(b) < time.Second && b.Sub(a) < time.Second
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
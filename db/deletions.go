@@ -0,0 +1,68 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// deletion schedules the deletion of the files of a token, once its document has expired
+type deletion struct {
+	Token string    `bson:"token"`
+	Due   time.Time `bson:"due"`
+}
+
+// scheduleDeletion schedules the deletion of the files of token at due
+func (db *DB) scheduleDeletion(ctx context.Context, token string, due time.Time) error {
+	_, err := db.deletions().UpdateOne(ctx, bson.M{"token": token}, bson.M{"$set": bson.M{"due": due}},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+// DueDeletions returns the tokens whose files can be deleted because their document is gone.
+// The deletions of tokens which still exist, because they were renewed or the TTL monitor
+// hasn't run yet, are postponed.
+func (db *DB) DueDeletions(ctx context.Context) ([]string, error) {
+	var due []deletion
+	cursor, err := db.deletions().Find(ctx, bson.M{"due": bson.M{"$lte": time.Now()}})
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &due); err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, each := range due {
+		tok, err := db.GetToken(ctx, each.Token)
+		if err != nil {
+			return result, err
+		}
+		if tok == nil {
+			result = append(result, each.Token)
+			continue
+		}
+		if err = db.scheduleDeletion(ctx, each.Token, postponed(tok)); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// DeletionDone is called once the files of a token returned by DueDeletions are deleted
+func (db *DB) DeletionDone(ctx context.Context, token string) error {
+	_, err := db.deletions().DeleteOne(ctx, bson.M{"token": token})
+	return err
+}
+
+// postponed returns when to check again the deletion of a token which still exists,
+// MongoDB's TTL monitor runs every minute
+func postponed(tok *Token) time.Time {
+	next := time.Now().Add(time.Minute)
+	if tok.ExpiresAt != nil && tok.ExpiresAt.After(next) {
+		return *tok.ExpiresAt
+	}
+	return next
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	// ErrNotFound is returned when updating a document which doesn't exist
+	ErrNotFound = errors.New("Not found")
+
+	// errDuplicate is returned by Bolt on unique key violations
+	errDuplicate = errors.New("Duplicate key")
+)
+
+// Store keeps the tokens, transactions, payment addresses, job locks and certificates.
+// DB stores them in MongoDB, Bolt in an embedded database for single node installs.
+// Every call takes the context of the request or job it is made for.
+//
+// Tokens and cached transactions expire at their ExpiresAt. When a token is created, the deletion
+// of its files is scheduled, DueDeletions returns the tokens whose files can be deleted.
+type Store interface {
+	// the certificates cache
+	autocert.Cache
+
+	CreateToken(ctx context.Context, token string, lifetime time.Duration) error
+	CreateDurableToken(ctx context.Context, token string, creator string, plan string, expires time.Time) error
+	GetToken(ctx context.Context, token string) (*Token, error)
+	TokenExists(ctx context.Context, token string, checkNoUpload bool) (bool, error)
+	TokenUploaded(ctx context.Context, token string, length int64, sha256 string, envelope string, timestamp time.Time) error
+	TokenUploadCreated(ctx context.Context, token string, length int64) error
+	TokenUploadFailed(ctx context.Context, token string, timestamp time.Time) error
+	TokenDownloaded(ctx context.Context, token *Token, timestamp time.Time) error
+	TokenCleared(ctx context.Context, token string) error
+	ExtendToken(ctx context.Context, token string, plan string, duration time.Duration) (time.Time, error)
+	TokenExpiryComputed(ctx context.Context, token string, expires time.Time) error
+	ListTokens(ctx context.Context) ([]Token, error)
+	RemoveToken(ctx context.Context, token string) error
+	RemoveExpiredTokens(ctx context.Context, lifetime time.Duration) ([]string, error)
+	RemoveExpiredUploads(ctx context.Context, plan string, withoutPlan bool, retention time.Duration) ([]string, error)
+
+	StoreTransaction(ctx context.Context, tx *Transaction) error
+	LoadTransaction(ctx context.Context, txid string) (*Transaction, error)
+	UnsettledTransactions(ctx context.Context, depth int) ([]Transaction, error)
+	TransactionConfirmed(ctx context.Context, txid string, confirmations int) error
+	TransactionMissed(ctx context.Context, txid string, missed int) error
+	RevokeTransaction(ctx context.Context, tx *Transaction) error
+	RemoveTransaction(ctx context.Context, txid string) error
+
+	StoreAddress(ctx context.Context, address *Address) error
+	FindAddress(ctx context.Context, addresses ...string) (*Address, error)
+	AddressPaid(ctx context.Context, address string, txid string, token string) error
+
+	AcquireLock(ctx context.Context, name string, owner string, ttl time.Duration) (bool, error)
+
+	DueDeletions(ctx context.Context) ([]string, error)
+	DeletionDone(ctx context.Context, token string) error
+
+	// Ping checks the database can be reached
+	Ping(ctx context.Context) error
+	Close()
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+const satoshi = 100000000
+
+// Account is an account involved in a bitcoin transaction
+type Account struct {
+	Account string  `json:"account"`
+	Value   float64 `json:"value"`
+	IsMine  bool    `json:"isMine"`
+}
+
+// ValueBTC returns the account value in BTC
+func (a *Account) ValueBTC() float64 {
+	return a.Value / satoshi
+}
+
+// Transaction models a bitcoin transaction
+type Transaction struct {
+	ID      string    `json:"id"`
+	Date    string    `json:"date"`
+	Outputs []Account `json:"outputs"`
+	Pending bool      `json:"pending"`
+
+	Confirmations int `json:"confirmations"`
+
+	Token   *string `bson:"token,omitempty" json:"-"` // only present in mongodb
+	Plan    string  `bson:"plan,omitempty" json:"-"`  // the plan it paid for
+	Revoked bool    `bson:"revoked,omitempty" json:"-"`
+
+	// Address is the address from /bitcoin it paid to, its token is only returned by the claim
+	Address string `bson:"address,omitempty" json:"-"`
+
+	// Missed is how many times in a row the provider didn't find it
+	Missed int `bson:"missed,omitempty" json:"-"`
+
+	// Extension is how much a renewal extended its token
+	Extension time.Duration `bson:"extension,omitempty" json:"-"`
+
+	// ExpiresAt is when the cached transaction is deleted by the TTL index
+	ExpiresAt *time.Time `bson:"expiresAt,omitempty" json:"-"`
+}
+
+// ErrPending is returned by Check when a transaction doesn't have enough confirmations yet
+var ErrPending = errors.New("Transaction is awaiting confirmation")
+
+// Check checks if a transaction paid at least priceBtc for a subscription which hasn't expired,
+// and is confirmed at least minConfirmations times
+func (t *Transaction) Check(priceBtc float64, expires time.Time, minConfirmations int) error {
+	if t.Revoked {
+		return errors.New("Transaction was revoked")
+	}
+	acc := t.GetOurAccountEntry()
+	if acc == nil {
+		return errors.New("EZCP wasn't the recepient of the transaction")
+	}
+	if expires.Before(time.Now()) {
+		return errors.New("Subscription has expired")
+	}
+	amount := acc.ValueBTC()
+	if amount < priceBtc {
+		return errors.New("Transaction amount wasn't enough")
+	}
+	if t.Pending || t.Confirmations < minConfirmations {
+		return ErrPending
+	}
+	return nil
+}
+
+// GetDate returns a time.Time object from json date
+func (t *Transaction) GetDate() time.Time {
+	tim, _ := time.Parse("2006-01-02T15:04:05.000Z", t.Date)
+	return tim
+}
+
+// GetOurAccountEntry returns the account entry that belongs to us, or nil if not found
+func (t *Transaction) GetOurAccountEntry() *Account {
+	for _, a := range t.Outputs {
+		if a.IsMine {
+			return &a
+		}
+	}
+	return nil
+}
@@ -0,0 +1,422 @@
+// Package envelope implements the format of files encrypted by the clients, end to end:
+// the server only ever sees the envelope, never the plaintext.
+//
+// An envelope is a header followed by the file in chunks encrypted with AES-256-GCM:
+//
+//	magic "ezcp-e2e", version 1, KDF, KDF iterations (uint32), chunk size (uint32),
+//	KDF salt (16 bytes), nonce prefix of the chunks (7 bytes)
+//
+// Integers are big endian. The key is derived from a passphrase with PBKDF2-HMAC-SHA256,
+// or from a random 32 bytes secret with HKDF-SHA256, which can be shared in the fragment
+// of a link since browsers don't send fragments to servers.
+//
+// Each chunk's nonce is the prefix, the chunk index (uint32) and whether it is the last chunk (1 byte),
+// and its additional data is the header, so chunks can't be reordered or dropped and the header
+// can't be altered. Every chunk but the last holds chunk size bytes of plaintext, the last one
+// holds the rest. There is at least one chunk, even if empty.
+//
+// Both KDFs and AES-GCM are available in browsers' WebCrypto: index.html decrypts envelopes too.
+package envelope
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// Magic starts every envelope
+	Magic = "ezcp-e2e"
+
+	// Version is the version of the format written
+	Version = 1
+
+	// HeaderSize is the size of a version 1 header
+	HeaderSize = len(Magic) + 1 + 1 + 4 + 4 + saltSize + noncePrefixSize
+
+	// DefaultChunkSize is the size of the plaintext of every chunk but the last
+	DefaultChunkSize = 64 * 1024
+
+	// DefaultIterations is the number of PBKDF2 iterations for passphrases
+	DefaultIterations = 600000
+
+	// minChunkSize, maxChunkSize and maxIterations bound what a header can ask from the reader
+	minChunkSize  = 1024
+	maxChunkSize  = 4 * 1024 * 1024
+	maxIterations = 10000000
+
+	secretSize      = 32
+	saltSize        = 16
+	noncePrefixSize = 7
+	tagSize         = 16
+
+	hkdfInfo = "ezcp-e2e v1"
+)
+
+// KDF is how the key of an envelope is derived
+type KDF byte
+
+// KDFs of version 1
+const (
+	HKDF   KDF = 1 // HKDF-SHA256 of a random secret
+	PBKDF2 KDF = 2 // PBKDF2-HMAC-SHA256 of a passphrase
+)
+
+func (k KDF) String() string {
+	switch k {
+	case HKDF:
+		return "hkdf-sha256"
+	case PBKDF2:
+		return "pbkdf2-sha256"
+	}
+	return fmt.Sprintf("kdf-%d", byte(k))
+}
+
+var (
+	// ErrNotEnvelope is returned when reading something which doesn't start with Magic
+	ErrNotEnvelope = errors.New("Not an encrypted envelope")
+
+	// ErrWrongKey is returned when the key doesn't decrypt the envelope, or it was altered
+	ErrWrongKey = errors.New("Wrong key or corrupted envelope")
+
+	// ErrTruncated is returned when an envelope ends within its header or a chunk
+	ErrTruncated = errors.New("Truncated envelope")
+)
+
+// Key is what an envelope is encrypted with: a passphrase or a secret
+type Key struct {
+	kdf      KDF
+	material []byte
+}
+
+// Passphrase returns the Key of a passphrase
+func Passphrase(passphrase string) Key {
+	return Key{PBKDF2, []byte(passphrase)}
+}
+
+// NewSecret returns a Key of a new random secret
+func NewSecret() (Key, error) {
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return Key{}, err
+	}
+	return Key{HKDF, secret}, nil
+}
+
+// ParseSecret returns the Key of a secret encoded by Key.Secret
+func ParseSecret(encoded string) (Key, error) {
+	secret, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(secret) != secretSize {
+		return Key{}, errors.New("Invalid envelope secret")
+	}
+	return Key{HKDF, secret}, nil
+}
+
+// Secret returns the secret of the Key in unpadded base64url, or "" for a passphrase
+func (k Key) Secret() string {
+	if k.kdf != HKDF {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(k.material)
+}
+
+// Link returns the link to download token from the page at base, with the secret in the fragment
+func Link(base string, token string, key Key) string {
+	if secret := key.Secret(); secret != "" {
+		return base + "#" + token + ":" + secret
+	}
+	return base + "#" + token
+}
+
+// ParseLink returns the token of a link returned by Link, and its secret if it has one
+func ParseLink(link string) (string, *Key, error) {
+	hash := strings.Index(link, "#")
+	if hash == -1 {
+		return "", nil, errors.New("No token in link")
+	}
+	fragment := link[hash+1:]
+	colon := strings.Index(fragment, ":")
+	if colon == -1 {
+		return fragment, nil, nil
+	}
+	key, err := ParseSecret(fragment[colon+1:])
+	if err != nil {
+		return "", nil, err
+	}
+	return fragment[:colon], &key, nil
+}
+
+// Header is the decoded header of an envelope
+type Header struct {
+	Version    byte
+	KDF        KDF
+	Iterations uint32
+	ChunkSize  uint32
+	Salt       []byte
+	Prefix     []byte
+
+	raw []byte
+}
+
+// ParseHeader decodes the header at the beginning of data
+func ParseHeader(data []byte) (*Header, error) {
+	if len(data) < len(Magic) || string(data[:len(Magic)]) != Magic {
+		return nil, ErrNotEnvelope
+	}
+	if len(data) < HeaderSize {
+		return nil, ErrTruncated
+	}
+	raw := data[:HeaderSize]
+	h := &Header{raw: append([]byte(nil), raw...)}
+	offset := len(Magic)
+	h.Version, h.KDF = raw[offset], KDF(raw[offset+1])
+	offset += 2
+	h.Iterations = binary.BigEndian.Uint32(raw[offset:])
+	h.ChunkSize = binary.BigEndian.Uint32(raw[offset+4:])
+	offset += 8
+	h.Salt = h.raw[offset : offset+saltSize]
+	h.Prefix = h.raw[offset+saltSize : HeaderSize]
+
+	if h.Version != Version {
+		return nil, fmt.Errorf("Unsupported envelope version %d", h.Version)
+	}
+	if h.KDF != HKDF && h.KDF != PBKDF2 {
+		return nil, errors.New("Unsupported envelope KDF " + h.KDF.String())
+	}
+	if h.KDF == PBKDF2 && (h.Iterations == 0 || h.Iterations > maxIterations) {
+		return nil, fmt.Errorf("Invalid envelope iterations %d", h.Iterations)
+	}
+	if h.ChunkSize < minChunkSize || h.ChunkSize > maxChunkSize {
+		return nil, fmt.Errorf("Invalid envelope chunk size %d", h.ChunkSize)
+	}
+	return h, nil
+}
+
+// Label describes the envelope, as "v1/pbkdf2-sha256"
+func (h *Header) Label() string {
+	return fmt.Sprintf("v%d/%s", h.Version, h.KDF)
+}
+
+// newHeader returns a header for key, with a new salt and nonce prefix
+func newHeader(key Key) (*Header, error) {
+	h := &Header{Version: Version, KDF: key.kdf, ChunkSize: DefaultChunkSize}
+	if key.kdf == PBKDF2 {
+		h.Iterations = DefaultIterations
+	}
+	h.raw = make([]byte, HeaderSize)
+	offset := copy(h.raw, Magic)
+	h.raw[offset], h.raw[offset+1] = h.Version, byte(h.KDF)
+	offset += 2
+	binary.BigEndian.PutUint32(h.raw[offset:], h.Iterations)
+	binary.BigEndian.PutUint32(h.raw[offset+4:], h.ChunkSize)
+	offset += 8
+	if _, err := rand.Read(h.raw[offset:]); err != nil {
+		return nil, err
+	}
+	h.Salt = h.raw[offset : offset+saltSize]
+	h.Prefix = h.raw[offset+saltSize:]
+	return h, nil
+}
+
+// aead derives the key of the envelope
+func (h *Header) aead(key Key) (cipher.AEAD, error) {
+	if key.kdf != h.KDF {
+		if h.KDF == PBKDF2 {
+			return nil, errors.New("The envelope is encrypted with a passphrase")
+		}
+		return nil, errors.New("The envelope is encrypted with a secret")
+	}
+	var derived []byte
+	if h.KDF == PBKDF2 {
+		derived = pbkdf2.Key(key.material, h.Salt, int(h.Iterations), 32, sha256.New)
+	} else {
+		derived = make([]byte, 32)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, key.material, h.Salt, []byte(hkdfInfo)), derived); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonce returns the nonce of a chunk
+func (h *Header) nonce(index uint32, last bool) []byte {
+	nonce := make([]byte, 0, noncePrefixSize+5)
+	nonce = append(nonce, h.Prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, index)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// Writer encrypts what is written to it into an envelope
+type Writer struct {
+	w      io.Writer
+	header *Header
+	aead   cipher.AEAD
+	chunk  []byte
+	index  uint32
+	err    error
+}
+
+// NewWriter returns a Writer of an envelope encrypted with key to w.
+// It must be closed to write the last chunk.
+func NewWriter(w io.Writer, key Key) (*Writer, error) {
+	header, err := newHeader(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := header.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(header.raw); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, header: header, aead: aead, chunk: make([]byte, 0, header.ChunkSize)}, nil
+}
+
+// Write encrypts p. A full chunk is only written once more is written, as it may be the last one.
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 && w.err == nil {
+		if len(w.chunk) == cap(w.chunk) {
+			w.seal(false)
+			continue
+		}
+		n := copy(w.chunk[len(w.chunk):cap(w.chunk)], p)
+		w.chunk = w.chunk[:len(w.chunk)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, w.err
+}
+
+// Close writes the last chunk, it doesn't close the underlying writer
+func (w *Writer) Close() error {
+	if w.err == nil {
+		w.seal(true)
+		if w.err == nil {
+			w.err = errors.New("Envelope closed")
+			return nil
+		}
+	}
+	return w.err
+}
+
+func (w *Writer) seal(last bool) {
+	if w.index == ^uint32(0) {
+		w.err = errors.New("Too large for an envelope")
+		return
+	}
+	sealed := w.aead.Seal(nil, w.header.nonce(w.index, last), w.chunk, w.header.raw)
+	if _, err := w.w.Write(sealed); err != nil {
+		w.err = err
+		return
+	}
+	w.chunk = w.chunk[:0]
+	w.index++
+}
+
+// Reader decrypts an envelope
+type Reader struct {
+	r      *bufio.Reader
+	header *Header
+	aead   cipher.AEAD
+	sealed []byte
+	plain  []byte
+	index  uint32
+	done   bool
+}
+
+// NewReader reads the header of the envelope in r, and returns a Reader of its plaintext.
+// The plaintext of a chunk is only returned once its authenticity has been verified,
+// still a read error means the plaintext read so far must be discarded.
+func NewReader(r io.Reader, key Key) (*Reader, error) {
+	buffered := bufio.NewReader(r)
+	raw := make([]byte, HeaderSize)
+	n, err := io.ReadFull(buffered, raw)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	header, err := ParseHeader(raw[:n])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := header.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: buffered, header: header, aead: aead, sealed: make([]byte, header.ChunkSize+tagSize)}, nil
+}
+
+// Header returns the header of the envelope
+func (r *Reader) Header() *Header {
+	return r.header
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk, a chunk is the last one when nothing follows it
+func (r *Reader) open() error {
+	n, err := io.ReadFull(r.r, r.sealed)
+	if err == io.EOF || (err == io.ErrUnexpectedEOF && n < tagSize) {
+		return ErrTruncated
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, err = r.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	plain, err := r.aead.Open(r.sealed[:0], r.header.nonce(r.index, last), r.sealed[:n], r.header.raw)
+	if err != nil {
+		return ErrWrongKey
+	}
+	r.plain, r.index, r.done = plain, r.index+1, last
+	return nil
+}
+
+// Detect returns the header of the envelope data starts with, or nil if it isn't an envelope
+func Detect(data []byte) *Header {
+	header, err := ParseHeader(data)
+	if err != nil {
+		return nil
+	}
+	return header
+}
@@ -0,0 +1,175 @@
+package envelope
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"testing"
+)
+
+// testSecret is the secret of the known answer, bytes 0 to 31
+var testSecret = Key{HKDF, []byte{
+	0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+	16, 17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31,
+}}
+
+func seal(t *testing.T, key Key, data []byte) []byte {
+	t.Helper()
+	var sealed bytes.Buffer
+	w, err := NewWriter(&sealed, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+func open(key Key, sealed []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	return data
+}
+
+func TestRoundTrip(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, DefaultChunkSize - 1, DefaultChunkSize, DefaultChunkSize + 1, 2 * DefaultChunkSize} {
+		data := randomData(size)
+		sealed := seal(t, secret, data)
+		chunks := (size + DefaultChunkSize - 1) / DefaultChunkSize
+		if chunks == 0 {
+			chunks = 1
+		}
+		if len(sealed) != HeaderSize+size+chunks*tagSize {
+			t.Errorf("%d bytes sealed in %d bytes, want %d chunks", size, len(sealed), chunks)
+		}
+		if read, err := open(secret, sealed); err != nil || !bytes.Equal(read, data) {
+			t.Errorf("%d bytes opened as %d bytes, %v", size, len(read), err)
+		}
+	}
+
+	passphrase := Passphrase("correct horse")
+	sealed := seal(t, passphrase, []byte("hello"))
+	if header := Detect(sealed); header == nil || header.Label() != "v1/pbkdf2-sha256" || header.Iterations != DefaultIterations {
+		t.Errorf("header = %+v", header)
+	}
+	if read, err := open(passphrase, sealed); err != nil || string(read) != "hello" {
+		t.Errorf("opened %q, %v", read, err)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	secret, _ := NewSecret()
+	sealed := seal(t, secret, randomData(2*DefaultChunkSize))
+
+	// without its last chunk, the first one wasn't sealed as the last
+	if _, err := open(secret, sealed[:HeaderSize+DefaultChunkSize+tagSize]); err != ErrWrongKey {
+		t.Errorf("truncated at a chunk boundary = %v, want ErrWrongKey", err)
+	}
+	if _, err := open(secret, sealed[:len(sealed)-1]); err != ErrWrongKey {
+		t.Errorf("truncated in a chunk = %v, want ErrWrongKey", err)
+	}
+	if _, err := open(secret, sealed[:HeaderSize+DefaultChunkSize+tagSize+tagSize-1]); err != ErrTruncated {
+		t.Errorf("truncated in a tag = %v, want ErrTruncated", err)
+	}
+	if _, err := open(secret, sealed[:HeaderSize]); err != ErrTruncated {
+		t.Errorf("header only = %v, want ErrTruncated", err)
+	}
+	if _, err := open(secret, sealed[:HeaderSize-1]); err != ErrTruncated {
+		t.Errorf("truncated header = %v, want ErrTruncated", err)
+	}
+	if _, err := open(secret, []byte("plain text, not an envelope")); err != ErrNotEnvelope {
+		t.Errorf("plain text = %v, want ErrNotEnvelope", err)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	passphrase := Passphrase("correct horse")
+	sealed := seal(t, passphrase, []byte("hello"))
+
+	if _, err := open(Passphrase("wrong horse"), sealed); err != ErrWrongKey {
+		t.Errorf("wrong passphrase = %v, want ErrWrongKey", err)
+	}
+	secret, _ := NewSecret()
+	if _, err := open(secret, sealed); err == nil {
+		t.Error("a passphrase envelope was opened with a secret")
+	}
+
+	// the header is authenticated, weaker KDF parameters don't go unnoticed
+	altered := append([]byte(nil), sealed...)
+	binary.BigEndian.PutUint32(altered[len(Magic)+2:], DefaultIterations-1)
+	if _, err := open(passphrase, altered); err != ErrWrongKey {
+		t.Errorf("altered iterations = %v, want ErrWrongKey", err)
+	}
+
+	// and a header can't ask for too much work or memory
+	for _, iterations := range []uint32{0, maxIterations + 1} {
+		binary.BigEndian.PutUint32(altered[len(Magic)+2:], iterations)
+		if _, err := ParseHeader(altered); err == nil {
+			t.Errorf("%d iterations accepted", iterations)
+		}
+	}
+	altered = append([]byte(nil), sealed...)
+	binary.BigEndian.PutUint32(altered[len(Magic)+6:], maxChunkSize+1)
+	if _, err := ParseHeader(altered); err == nil {
+		t.Error("a too large chunk size was accepted")
+	}
+	altered[len(Magic)] = 2
+	if _, err := ParseHeader(altered); err == nil {
+		t.Error("version 2 was accepted")
+	}
+}
+
+// TestKnownAnswer pins the layout index.html parses: the header is 41 bytes, the salt at 18 and
+// the nonce prefix at 34, and the nonce of the last chunk ends with its index and 1.
+func TestKnownAnswer(t *testing.T) {
+	header, _ := hex.DecodeString("657a63702d653265" + "01" + "01" + "00000000" + "00000400" +
+		"a0a1a2a3a4a5a6a7a8a9aaabacadaeaf" + "01020304050607")
+	chunk, _ := hex.DecodeString("2347590a9dee93541ebf3745bda6874bc6b647126ca7956bb74806")
+	if HeaderSize != 41 || len(header) != HeaderSize {
+		t.Fatalf("HeaderSize = %d, index.html expects 41", HeaderSize)
+	}
+
+	parsed, err := ParseHeader(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Version != 1 || parsed.KDF != HKDF || parsed.Iterations != 0 || parsed.ChunkSize != 1024 ||
+		parsed.Salt[0] != 0xa0 || parsed.Prefix[0] != 1 || len(parsed.Prefix) != noncePrefixSize {
+		t.Errorf("header = %+v", parsed)
+	}
+	if read, err := open(testSecret, append(header, chunk...)); err != nil || string(read) != "hello, ezcp" {
+		t.Errorf("opened %q, %v", read, err)
+	}
+
+	// the Writer seals the same with the same header
+	aead, err := parsed.aead(testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sealed bytes.Buffer
+	w := &Writer{w: &sealed, header: parsed, aead: aead, chunk: make([]byte, 0, parsed.ChunkSize)}
+	w.Write([]byte("hello, ezcp"))
+	w.Close()
+	if !bytes.Equal(sealed.Bytes(), chunk) {
+		t.Errorf("sealed %x, want %x", sealed.Bytes(), chunk)
+	}
+}
@@ -0,0 +1,96 @@
+package health
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"ezcp.io/ezcp-server/storage"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// probeToken returns a random token to write a probe file, so servers sharing a storage don't collide
+func probeToken() (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return "healthz-" + hex.EncodeToString(random), nil
+}
+
+// StorageWritable checks a file can be stored and deleted
+func StorageWritable(store storage.Storage) Check {
+	return func(ctx context.Context) error {
+		token, err := probeToken()
+		if err != nil {
+			return err
+		}
+		if _, err = store.Put(token, strings.NewReader("ok")); err != nil {
+			return err
+		}
+		return store.Delete(token)
+	}
+}
+
+// StagingWritable checks a partial upload can be created and removed
+func StagingWritable(staging *storage.Staging) Check {
+	return func(ctx context.Context) error {
+		token, err := probeToken()
+		if err != nil {
+			return err
+		}
+		if err = staging.Create(token); err != nil {
+			return err
+		}
+		return staging.Remove(token)
+	}
+}
+
+// FreeSpace checks the filesystem of path has at least min bytes available
+func FreeSpace(path string, min uint64) Check {
+	return func(ctx context.Context) error {
+		free, err := storage.FreeSpace(path)
+		if err != nil {
+			return err
+		}
+		if free < min {
+			return fmt.Errorf("%d bytes free in %s, below %d", free, path, min)
+		}
+		return nil
+	}
+}
+
+// Certificates checks the certificate manager's cache has a valid certificate for host.
+// It never obtains one: probes would hit the rate limits of Let's Encrypt while issuance fails.
+func Certificates(manager *autocert.Manager, host string) Check {
+	return func(ctx context.Context) error {
+		data, err := manager.Cache.Get(ctx, host)
+		if err == autocert.ErrCacheMiss {
+			return errors.New("No certificate for " + host + " yet")
+		}
+		if err != nil {
+			return err
+		}
+		// the private key then the certificate chain, in PEM
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return err
+			}
+			if time.Now().After(cert.NotAfter) {
+				return errors.New("The certificate for " + host + " has expired")
+			}
+			return nil
+		}
+		return errors.New("Invalid cached certificate for " + host)
+	}
+}
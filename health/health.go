@@ -0,0 +1,147 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Check returns an error when a subsystem isn't ready to serve requests
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker serves the health, Readiness and version endpoints.
+// Subsystems register their Readiness checks, which run concurrently on /readyz.
+// Their result is cached, so probes don't hit the database and the storage on every request.
+type Checker struct {
+	timeout time.Duration
+	cache   time.Duration
+	tag     string
+	build   string
+
+	mutex  sync.Mutex
+	checks []namedCheck
+
+	running sync.Mutex // held while the checks run, so they don't run concurrently
+	cached  *Readiness
+	checked time.Time
+}
+
+// NewChecker returns a Checker whose checks fail after timeout, and whose result is cached for cache.
+// tag and build describe the version.
+func NewChecker(timeout time.Duration, cache time.Duration, tag string, build string) *Checker {
+	return &Checker{timeout: timeout, cache: cache, tag: tag, build: build}
+}
+
+// Register adds a Readiness check
+func (c *Checker) Register(name string, check Check) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.checks = append(c.checks, namedCheck{name, check})
+}
+
+// Readiness is the result of the checks, and the JSON body of /readyz
+type Readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"` // "ok" or the error
+}
+
+// Healthz handles /healthz, it answers as long as the process is alive
+func (c *Checker) Healthz(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(200)
+	res.Write([]byte("ok"))
+}
+
+// Readyz handles /readyz, it answers 200 if every check passed and 503 otherwise
+func (c *Checker) Readyz(res http.ResponseWriter, req *http.Request) {
+	result := c.Cached(req.Context())
+	status := 200
+	if !result.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(res, status, result)
+}
+
+// Cached returns the result of the checks, which run again once it is older than the cache duration
+func (c *Checker) Cached(ctx context.Context) Readiness {
+	c.running.Lock()
+	defer c.running.Unlock()
+	if c.cached == nil || time.Since(c.checked) >= c.cache {
+		result := c.Run(ctx)
+		c.cached, c.checked = &result, time.Now()
+	}
+	return *c.cached
+}
+
+// Run runs every check concurrently, until the timeout
+func (c *Checker) Run(ctx context.Context) Readiness {
+	c.mutex.Lock()
+	checks := append([]namedCheck(nil), c.checks...)
+	c.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	errs := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i, each := range checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			errs[i] = run(ctx, check)
+		}(i, each.check)
+	}
+	wg.Wait()
+
+	result := Readiness{Ready: true, Checks: make(map[string]string, len(checks))}
+	for i, each := range checks {
+		result.Checks[each.name] = "ok"
+		if errs[i] != nil {
+			result.Ready = false
+			result.Checks[each.name] = errs[i].Error()
+		}
+	}
+	return result
+}
+
+// run runs a check, and gives up when ctx is done in case the check ignores it
+func run(ctx context.Context, check Check) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Version handles /version, with the tag and build set by CI
+func (c *Checker) Version(res http.ResponseWriter, req *http.Request) {
+	tag := c.tag
+	if tag == "" && c.build == "" {
+		tag = "development"
+	}
+	writeJSON(res, 200, map[string]string{
+		"tag":   tag,
+		"build": c.build,
+		"go":    runtime.Version(),
+	})
+}
+
+func writeJSON(res http.ResponseWriter, status int, body interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(body)
+}
@@ -0,0 +1,50 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadyz(t *testing.T) {
+	checker := NewChecker(time.Second, time.Hour, "", "")
+	runs := 0
+	var failure error
+	checker.Register("counted", func(ctx context.Context) error {
+		runs++
+		return failure
+	})
+
+	readyz := func() int {
+		res := httptest.NewRecorder()
+		checker.Readyz(res, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return res.Code
+	}
+	if status := readyz(); status != 200 {
+		t.Errorf("status = %d, want 200", status)
+	}
+
+	// the result is cached, probes don't run the checks every time
+	failure = errors.New("down")
+	if status := readyz(); status != 200 || runs != 1 {
+		t.Errorf("status = %d after %d runs, want the cached 200", status, runs)
+	}
+	checker.cache = 0
+	if status := readyz(); status != http.StatusServiceUnavailable || runs != 2 {
+		t.Errorf("status = %d after %d runs, want 503", status, runs)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	checker := NewChecker(10*time.Millisecond, 0, "", "")
+	checker.Register("stuck", func(ctx context.Context) error {
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	})
+	if result := checker.Run(context.Background()); result.Ready || result.Checks["stuck"] != context.DeadlineExceeded.Error() {
+		t.Errorf("Run = %+v", result)
+	}
+}
@@ -0,0 +1,121 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"ezcp.io/ezcp-server/db"
+	"ezcp.io/ezcp-server/storage"
+)
+
+// Kinds of mismatches found by the Reconciler
+const (
+	OrphanedFile   = "orphaned-file"   // a stored file without an uploaded token
+	OrphanedUpload = "orphaned-upload" // a partial upload without a token
+	DanglingToken  = "dangling-token"  // an uploaded token without a stored file
+)
+
+// Mismatch is an inconsistency between the storage and the database
+type Mismatch struct {
+	Kind      string
+	Token     string
+	Permanent bool
+	Repaired  bool
+}
+
+// Reconciler finds, and optionally repairs, files without tokens and tokens without files
+type Reconciler struct {
+	db      db.Store
+	storage storage.Storage
+	staging *storage.Staging
+
+	// Repair removes orphaned files and forgets the uploads of dangling tokens
+	Repair bool
+
+	// MinAge is how old a file or upload must be, so uploads and downloads in progress are left alone
+	MinAge time.Duration
+}
+
+// NewReconciler returns a new Reconciler
+func NewReconciler(database db.Store, store storage.Storage, staging *storage.Staging, repair bool, minAge time.Duration) *Reconciler {
+	return &Reconciler{database, store, staging, repair, minAge}
+}
+
+// Reconcile walks the storage and the tokens collection and returns the mismatches
+func (r *Reconciler) Reconcile(ctx context.Context) ([]Mismatch, error) {
+	tokens, err := r.db.ListTokens(ctx)
+	if err != nil {
+		return nil, err
+	}
+	files, err := r.storage.List()
+	if err != nil {
+		return nil, err
+	}
+	uploads, err := r.staging.List()
+	if err != nil {
+		return nil, err
+	}
+
+	before := time.Now().Add(-r.MinAge)
+	byName := make(map[string]*db.Token, len(tokens))
+	for i := range tokens {
+		byName[tokens[i].Token] = &tokens[i]
+	}
+
+	var result []Mismatch
+	stored := make(map[string]bool, len(files))
+	for _, file := range files {
+		stored[file.Token] = true
+		tok := byName[file.Token]
+		if (tok == nil || tok.Uploaded == nil) && file.Modified.Before(before) {
+			result = append(result, r.repair(ctx, Mismatch{Kind: OrphanedFile, Token: file.Token}))
+		}
+	}
+	for _, upload := range uploads {
+		if byName[upload.Token] == nil && upload.Modified.Before(before) {
+			result = append(result, r.repair(ctx, Mismatch{Kind: OrphanedUpload, Token: upload.Token}))
+		}
+	}
+	for _, tok := range tokens {
+		if tok.Uploaded != nil && !stored[tok.Token] && tok.Uploaded.Before(before) {
+			result = append(result, r.repair(ctx, Mismatch{Kind: DanglingToken, Token: tok.Token, Permanent: tok.Permanent}))
+		}
+	}
+	return result, nil
+}
+
+// Job reconciles and logs the mismatches, it can be run by a Scheduler
+func (r *Reconciler) Job(ctx context.Context) (int, error) {
+	mismatches, err := r.Reconcile(ctx)
+	for _, each := range mismatches {
+		log.Printf("Reconcile: %s %s repaired=%v", each.Kind, each.Token, each.Repaired)
+	}
+	return len(mismatches), err
+}
+
+func (r *Reconciler) repair(ctx context.Context, m Mismatch) Mismatch {
+	if !r.Repair {
+		return m
+	}
+
+	var err error
+	switch m.Kind {
+	case OrphanedFile:
+		err = r.storage.Delete(m.Token)
+	case OrphanedUpload:
+		err = r.staging.Remove(m.Token)
+	case DanglingToken:
+		if m.Permanent { // permanent tokens can be uploaded again
+			err = r.db.TokenCleared(ctx, m.Token)
+		} else {
+			err = r.db.RemoveToken(ctx, m.Token)
+		}
+	}
+	if err != nil && err != storage.ErrNotFound {
+		log.Print("Can't repair ", m.Kind, " ", m.Token, err)
+		return m
+	}
+	m.Repaired = true
+	return m
+}
@@ -0,0 +1,137 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"ezcp.io/ezcp-server/db"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	runsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "job_runs_counts",
+		Help: "Background job runs, by result",
+	}, []string{"job", "result"})
+
+	itemsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "job_items_counts",
+		Help: "Items processed by background jobs",
+	}, []string{"job"})
+
+	durationSummary = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Name: "job_duration_seconds",
+		Help: "Background job durations",
+	}, []string{"job"})
+
+	lastSuccessGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "job_last_success_timestamp_seconds",
+		Help: "Time of the last successful run of background jobs",
+	}, []string{"job"})
+)
+
+// RegisterPrometheus registers the background jobs metrics
+func RegisterPrometheus() {
+	prometheus.MustRegister(runsCounter)
+	prometheus.MustRegister(itemsCounter)
+	prometheus.MustRegister(durationSummary)
+	prometheus.MustRegister(lastSuccessGauge)
+}
+
+// Func is a job, it returns how many items it processed.
+// ctx is cancelled when the scheduler stops.
+type Func func(ctx context.Context) (int, error)
+
+type job struct {
+	name     string
+	interval time.Duration
+	run      Func
+}
+
+// Scheduler runs jobs periodically.
+// When several servers share the database, each job runs on one server at a time.
+type Scheduler struct {
+	db    db.Store
+	owner string
+	jobs  []job
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewScheduler returns a new Scheduler, owner identifies this server
+func NewScheduler(database db.Store, owner string) *Scheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{db: database, owner: owner, ctx: ctx, cancel: cancel}
+}
+
+// Add adds a job to run every interval, it must be called before Start
+func (s *Scheduler) Add(name string, interval time.Duration, run Func) {
+	s.jobs = append(s.jobs, job{name, interval, run})
+}
+
+// Start starts running the jobs in the background
+func (s *Scheduler) Start() {
+	for _, each := range s.jobs {
+		s.wg.Add(1)
+		go s.loop(each)
+	}
+}
+
+// Stop stops the jobs and waits for the running ones
+func (s *Scheduler) Stop() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+func (s *Scheduler) loop(j job) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		s.runIfLeader(j)
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// runIfLeader runs the job if this server holds its lock, the lock expires after
+// one interval so another server takes over if this one dies
+func (s *Scheduler) runIfLeader(j job) {
+	leader, err := s.db.AcquireLock(s.ctx, "job:"+j.name, s.owner, j.interval)
+	if err != nil {
+		log.Print("Can't acquire lock for job ", j.name, err)
+		runsCounter.WithLabelValues(j.name, "error").Inc()
+		return
+	}
+	if !leader {
+		runsCounter.WithLabelValues(j.name, "skipped").Inc()
+		return
+	}
+	Run(s.ctx, j.name, j.run)
+}
+
+// Run runs a job once and records its metrics
+func Run(ctx context.Context, name string, run Func) (int, error) {
+	start := time.Now()
+	count, err := run(ctx)
+	durationSummary.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	itemsCounter.WithLabelValues(name).Add(float64(count))
+	if err != nil {
+		log.Print("Job ", name, " failed: ", err)
+		runsCounter.WithLabelValues(name, "error").Inc()
+		return count, err
+	}
+	runsCounter.WithLabelValues(name, "success").Inc()
+	lastSuccessGauge.WithLabelValues(name).Set(float64(time.Now().Unix()))
+	if count > 0 {
+		log.Printf("Job %s processed %d items", name, count)
+	}
+	return count, nil
+}
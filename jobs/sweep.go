@@ -0,0 +1,76 @@
+package jobs
+
+import (
+	"context"
+	"log"
+
+	"ezcp.io/ezcp-server/db"
+	"ezcp.io/ezcp-server/plans"
+	"ezcp.io/ezcp-server/storage"
+)
+
+// Sweeper removes expired tokens and files
+type Sweeper struct {
+	db      db.Store
+	storage storage.Storage
+	staging *storage.Staging
+	plans   *plans.Catalog
+}
+
+// NewSweeper returns a new Sweeper, which keeps files as long as their token's plan
+func NewSweeper(database db.Store, store storage.Storage, staging *storage.Staging, catalog *plans.Catalog) *Sweeper {
+	return &Sweeper{database, store, staging, catalog}
+}
+
+// SweepTransient removes the expired transient tokens and their files
+func (s *Sweeper) SweepTransient(ctx context.Context) (int, error) {
+	free := s.plans.Get(s.plans.Free)
+	tokens, err := s.db.RemoveExpiredTokens(ctx, free.Retention.Std())
+	if err != nil {
+		return 0, err
+	}
+	s.remove(tokens)
+	return len(tokens), nil
+}
+
+// SweepPermanent removes the files of permanent tokens older than their plan's retention period
+func (s *Sweeper) SweepPermanent(ctx context.Context) (int, error) {
+	count := 0
+	for _, plan := range s.plans.Paid() {
+		tokens, err := s.db.RemoveExpiredUploads(ctx, plan.Name, plan.Name == s.plans.Default, plan.Retention.Std())
+		s.remove(tokens)
+		count += len(tokens)
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// SweepBlobs removes the files of the tokens the database has expired
+func (s *Sweeper) SweepBlobs(ctx context.Context) (int, error) {
+	tokens, err := s.db.DueDeletions(ctx)
+	if err != nil {
+		return 0, err
+	}
+	s.remove(tokens)
+	for i, each := range tokens {
+		if err = s.db.DeletionDone(ctx, each); err != nil {
+			return i, err
+		}
+	}
+	return len(tokens), nil
+}
+
+func (s *Sweeper) remove(tokens []string) {
+	for _, each := range tokens {
+		err := s.storage.Delete(each)
+		if err != nil && err != storage.ErrNotFound {
+			log.Print("Can't remove file ", each, err)
+		}
+		err = s.staging.Remove(each)
+		if err != nil && err != storage.ErrNotFound {
+			log.Print("Can't remove partial upload ", each, err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package jobs
+
+import (
+	"context"
+	"log"
+
+	"ezcp.io/ezcp-server/db"
+	"ezcp.io/ezcp-server/payment"
+	"ezcp.io/ezcp-server/storage"
+)
+
+// revokeAfterMisses is how many checks in a row must not find a transaction before it is revoked,
+// so a transient or configuration error of the provider doesn't revoke tokens
+const revokeAfterMisses = 3
+
+// Verifier checks again the transactions permanent tokens were issued or renewed for,
+// until they're settled, and revokes the tokens or renewals if a transaction disappears
+type Verifier struct {
+	db       db.Store
+	provider payment.Provider
+	storage  storage.Storage
+
+	// SettledConfirmations is the depth after which a transaction isn't checked anymore
+	SettledConfirmations int
+}
+
+// NewVerifier returns a new Verifier
+func NewVerifier(database db.Store, provider payment.Provider, store storage.Storage, settledConfirmations int) *Verifier {
+	return &Verifier{database, provider, store, settledConfirmations}
+}
+
+// Verify checks the unsettled transactions and returns how many were revoked.
+// It stops at the first lookup error.
+func (v *Verifier) Verify(ctx context.Context) (int, error) {
+	transactions, err := v.db.UnsettledTransactions(ctx, v.SettledConfirmations)
+	if err != nil {
+		return 0, err
+	}
+
+	revoked := 0
+	for i := range transactions {
+		tx := &transactions[i]
+		current, err := v.provider.LookupTransaction(tx.ID)
+		if err != nil {
+			return revoked, err
+		}
+
+		if current == nil || current.GetOurAccountEntry() == nil {
+			if tx.Missed+1 < revokeAfterMisses {
+				log.Print("Transaction ", tx.ID, " not found, ", tx.Missed+1, " times in a row")
+				if err = v.db.TransactionMissed(ctx, tx.ID, tx.Missed+1); err != nil {
+					return revoked, err
+				}
+				continue
+			}
+			log.Print("Transaction ", tx.ID, " disappeared, revoking its token")
+			if err = v.db.RevokeTransaction(ctx, tx); err != nil {
+				return revoked, err
+			}
+			if tx.Token != nil && tx.Extension == 0 {
+				err = v.storage.Delete(*tx.Token)
+				if err != nil && err != storage.ErrNotFound {
+					log.Print("Can't remove file ", *tx.Token, err)
+				}
+			}
+			revoked++
+			continue
+		}
+
+		if tx.Missed > 0 {
+			if err = v.db.TransactionMissed(ctx, tx.ID, 0); err != nil {
+				return revoked, err
+			}
+		}
+		if current.Confirmations != tx.Confirmations {
+			if err = v.db.TransactionConfirmed(ctx, tx.ID, current.Confirmations); err != nil {
+				return revoked, err
+			}
+		}
+	}
+	return revoked, nil
+}
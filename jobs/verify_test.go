@@ -0,0 +1,77 @@
+package jobs
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ezcp.io/ezcp-server/db"
+	"ezcp.io/ezcp-server/payment"
+	"ezcp.io/ezcp-server/payment/bitgotest"
+	"ezcp.io/ezcp-server/storage"
+)
+
+func TestVerifier(t *testing.T) {
+	ctx := context.Background()
+	bitgo := bitgotest.NewServer("wallet", "bitgo-token")
+	defer bitgo.Close()
+	database, err := db.NewBolt(filepath.Join(t.TempDir(), "ezcp.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	store := storage.NewMemory()
+
+	token := "minted"
+	database.CreateDurableToken(ctx, token, "tx1", "basic", time.Now().Add(time.Hour))
+	store.Put(token, strings.NewReader("hello"))
+	database.StoreTransaction(ctx, &db.Transaction{ID: "tx1", Token: &token, Confirmations: 2})
+	bitgo.AddTransaction(db.Transaction{ID: "tx1", Outputs: []db.Account{{Account: "address", Value: 10000, IsMine: true}}, Confirmations: 3})
+
+	verifier := NewVerifier(database, payment.NewBitgo(bitgo.URL, "bitgo-token", "wallet"), store, 6)
+	if revoked, err := verifier.Verify(ctx); revoked != 0 || err != nil {
+		t.Fatalf("Verify = %d, %v", revoked, err)
+	}
+	if tx, _ := database.LoadTransaction(ctx, "tx1"); tx.Confirmations != 3 {
+		t.Errorf("confirmations = %d, want 3", tx.Confirmations)
+	}
+
+	// a wrong wallet doesn't revoke anything
+	misconfigured := NewVerifier(database, payment.NewBitgo(bitgo.URL, "bitgo-token", "other"), store, 6)
+	for i := 0; i < revokeAfterMisses; i++ {
+		if _, err = misconfigured.Verify(ctx); err == nil {
+			t.Fatal("Verify with a wrong wallet succeeded")
+		}
+	}
+
+	// a transaction missing once comes back
+	bitgo.RemoveTransaction("tx1")
+	verifier.Verify(ctx)
+	bitgo.AddTransaction(db.Transaction{ID: "tx1", Outputs: []db.Account{{Account: "address", Value: 10000, IsMine: true}}, Confirmations: 4})
+	verifier.Verify(ctx)
+	if tx, _ := database.LoadTransaction(ctx, "tx1"); tx.Missed != 0 || tx.Revoked {
+		t.Errorf("transaction found again = %+v", tx)
+	}
+
+	// a double spent transaction is revoked after several misses in a row
+	bitgo.RemoveTransaction("tx1")
+	for i := 1; i < revokeAfterMisses; i++ {
+		if revoked, err := verifier.Verify(ctx); revoked != 0 || err != nil {
+			t.Fatalf("Verify after %d misses = %d, %v", i, revoked, err)
+		}
+	}
+	if revoked, err := verifier.Verify(ctx); revoked != 1 || err != nil {
+		t.Fatalf("Verify = %d, %v, want 1 revoked", revoked, err)
+	}
+	if tok, _ := database.GetToken(ctx, token); tok != nil {
+		t.Error("the token wasn't revoked")
+	}
+	if _, err = store.Stat(token); err != storage.ErrNotFound {
+		t.Errorf("the file of the revoked token is still stored: %v", err)
+	}
+	if revoked, _ := verifier.Verify(ctx); revoked != 0 {
+		t.Error("a revoked transaction was verified again")
+	}
+}
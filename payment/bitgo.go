@@ -0,0 +1,108 @@
+package payment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"ezcp.io/ezcp-server/db"
+)
+
+// BitgoURL is the default BitGo API base URL
+const BitgoURL = "https://www.bitgo.com/api/v1"
+
+// ErrTransactionNotFound is returned when the provider doesn't know a transaction
+var ErrTransactionNotFound = errors.New("Transaction not found")
+
+// Bitgo is a Provider using a BitGo wallet
+type Bitgo struct {
+	baseURL string
+	token   string
+	wallet  string
+	client  *http.Client
+}
+
+// NewBitgo returns a new Bitgo provider for wallet, using the API at baseURL
+func NewBitgo(baseURL string, token string, wallet string) *Bitgo {
+	return &Bitgo{strings.TrimSuffix(baseURL, "/"), token, wallet, &http.Client{}}
+}
+
+// NewAddress returns a new Bitgo address
+func (b *Bitgo) NewAddress() (string, error) {
+	var result struct {
+		Address string `json:"address"`
+	}
+	if err := b.do("POST", "/wallet/"+b.wallet+"/address/0", &result); err != nil {
+		return "", err
+	}
+	if result.Address == "" {
+		return "", errors.New("No address returned by Bitgo")
+	}
+	return result.Address, nil
+}
+
+// LookupTransaction returns a transaction from Bitgo.
+// A transaction is only not found if the wallet is, so a wrong wallet or URL is an error.
+func (b *Bitgo) LookupTransaction(txid string) (*db.Transaction, error) {
+	transaction := &db.Transaction{}
+	err := b.do("GET", "/wallet/"+b.wallet+"/tx/"+txid, transaction)
+	if status, ok := err.(*statusError); ok && status.code == http.StatusNotFound {
+		var wallet struct {
+			ID string `json:"id"`
+		}
+		if err = b.do("GET", "/wallet/"+b.wallet, &wallet); err != nil {
+			return nil, fmt.Errorf("Can't tell if transaction %s exists: %s", txid, err)
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return transaction, nil
+}
+
+// Confirmations returns the current number of confirmations of a transaction
+func (b *Bitgo) Confirmations(txid string) (int, error) {
+	transaction, err := b.LookupTransaction(txid)
+	if err != nil {
+		return 0, err
+	}
+	if transaction == nil {
+		return 0, ErrTransactionNotFound
+	}
+	return transaction.Confirmations, nil
+}
+
+func (b *Bitgo) do(method string, path string, result interface{}) error {
+	req, err := http.NewRequest(method, b.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.token)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{method + " " + path, resp.StatusCode, resp.Status}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("Can't parse Bitgo response: %s", err)
+	}
+	return nil
+}
+
+// statusError is a Bitgo answer other than 200 OK
+type statusError struct {
+	request string
+	code    int
+	status  string
+}
+
+func (e *statusError) Error() string {
+	return "Bitgo " + e.request + ": " + e.status
+}
@@ -0,0 +1,102 @@
+// Package bitgotest provides a fake BitGo API with scripted transactions,
+// so the payment flow can be tested without reaching www.bitgo.com.
+package bitgotest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"ezcp.io/ezcp-server/db"
+)
+
+// Server is a fake BitGo API for one wallet, its URL is a valid base URL for payment.NewBitgo
+type Server struct {
+	*httptest.Server
+
+	Wallet string
+	Token  string
+
+	mutex        sync.Mutex
+	transactions map[string]db.Transaction
+	addresses    []string
+}
+
+// NewServer starts a new fake BitGo API, callers should Close it when done
+func NewServer(wallet string, token string) *Server {
+	s := &Server{Wallet: wallet, Token: token, transactions: make(map[string]db.Transaction)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// AddTransaction adds or replaces a transaction returned by the API
+func (s *Server) AddTransaction(tx db.Transaction) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.transactions[tx.ID] = tx
+}
+
+// SetConfirmations changes the confirmations of a transaction, it isn't pending anymore once confirmed
+func (s *Server) SetConfirmations(txid string, confirmations int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tx := s.transactions[txid]
+	tx.Confirmations = confirmations
+	tx.Pending = confirmations == 0
+	s.transactions[txid] = tx
+}
+
+// RemoveTransaction makes a transaction disappear, as after a double spend
+func (s *Server) RemoveTransaction(txid string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.transactions, txid)
+}
+
+// Addresses returns the addresses created so far
+func (s *Server) Addresses() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.addresses...)
+}
+
+func (s *Server) serveHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != "Bearer "+s.Token {
+		res.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	prefix := "/wallet/" + s.Wallet
+	if req.URL.Path != prefix && !strings.HasPrefix(req.URL.Path, prefix+"/") {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, prefix), "/")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch {
+	case req.Method == http.MethodGet && path == "":
+		json.NewEncoder(res).Encode(map[string]string{"id": s.Wallet})
+
+	case req.Method == http.MethodPost && path == "address/0":
+		address := fmt.Sprintf("2MfakeBitgoAddress%06d", len(s.addresses)+1)
+		s.addresses = append(s.addresses, address)
+		json.NewEncoder(res).Encode(map[string]string{"address": address})
+
+	case req.Method == http.MethodGet && strings.HasPrefix(path, "tx/"):
+		tx, ok := s.transactions[strings.TrimPrefix(path, "tx/")]
+		if !ok {
+			res.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(res).Encode(tx)
+
+	default:
+		res.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,15 @@
+package payment
+
+import "ezcp.io/ezcp-server/db"
+
+// Provider receives the payments for permanent tokens
+type Provider interface {
+	// NewAddress returns a new address to send a payment to
+	NewAddress() (string, error)
+
+	// LookupTransaction returns a transaction, or nil if the provider doesn't know it
+	LookupTransaction(txid string) (*db.Transaction, error)
+
+	// Confirmations returns the current number of confirmations of a transaction
+	Confirmations(txid string) (int, error)
+}
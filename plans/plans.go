@@ -0,0 +1,227 @@
+package plans
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const mib = 1048576
+
+// Plan is what a token allows
+type Plan struct {
+	Name         string   `json:"name" yaml:"name"`
+	Price        float64  `json:"price" yaml:"price"`               // 0 for the free plan
+	Currency     string   `json:"currency" yaml:"currency"`         // BTC, USD, EUR...
+	Duration     Duration `json:"duration" yaml:"duration"`         // how long a subscription lasts
+	MaxFileSize  int64    `json:"maxFileSize" yaml:"maxFileSize"`   // in bytes
+	Retention    Duration `json:"retention" yaml:"retention"`       // how long uploaded files are kept
+	MaxDownloads int      `json:"maxDownloads" yaml:"maxDownloads"` // before a file is deleted, 0 for unlimited
+}
+
+// IsValidSize returns true if the plan allows this file size, false otherwise
+func (p *Plan) IsValidSize(size int64) bool {
+	return size <= p.MaxSize()
+}
+
+// MaxSize returns the largest file size the plan allows, MaxFileSize is excluded
+func (p *Plan) MaxSize() int64 {
+	return p.MaxFileSize - 1
+}
+
+// Catalog is the list of available plans
+type Catalog struct {
+	Plans []Plan `json:"plans" yaml:"plans"`
+
+	// Free is the plan of transient tokens
+	Free string `json:"free" yaml:"free"`
+
+	// Default is the plan of permanent tokens bought before plans existed
+	Default string `json:"default" yaml:"default"`
+}
+
+// DefaultCatalog returns the historical plans: free transient tokens and a year of premium for 0.01 BTC
+func DefaultCatalog() *Catalog {
+	return &Catalog{
+		Plans: []Plan{
+			{Name: "free", Currency: "BTC", MaxFileSize: 25 * mib, Retention: Duration(time.Hour), MaxDownloads: 1},
+			{Name: "premium", Price: 0.01, Currency: "BTC", Duration: Duration(365 * 24 * time.Hour),
+				MaxFileSize: 150 * mib, Retention: Duration(24 * time.Hour), MaxDownloads: 1},
+		},
+		Free:    "free",
+		Default: "premium",
+	}
+}
+
+// Validate checks the catalog is consistent
+func (c *Catalog) Validate() error {
+	names := make(map[string]bool)
+	for _, plan := range c.Plans {
+		if plan.Name == "" {
+			return errors.New("Plan without a name")
+		}
+		if names[plan.Name] {
+			return errors.New("Duplicate plan " + plan.Name)
+		}
+		names[plan.Name] = true
+		if plan.MaxFileSize <= 0 {
+			return errors.New("Plan " + plan.Name + " needs a maxFileSize")
+		}
+		if plan.Retention <= 0 {
+			return errors.New("Plan " + plan.Name + " needs a retention")
+		}
+		if plan.Price > 0 && (plan.Currency == "" || plan.Duration <= 0) {
+			return errors.New("Paid plan " + plan.Name + " needs a currency and a duration")
+		}
+	}
+	if free := c.Get(c.Free); free == nil || free.Price != 0 {
+		return errors.New("Unknown or paid free plan " + c.Free)
+	}
+	if paid := c.Get(c.Default); paid == nil || paid.Price == 0 {
+		return errors.New("Unknown or free default plan " + c.Default)
+	}
+	return nil
+}
+
+// Get returns the named plan, or nil
+func (c *Catalog) Get(name string) *Plan {
+	for i := range c.Plans {
+		if c.Plans[i].Name == name {
+			return &c.Plans[i]
+		}
+	}
+	return nil
+}
+
+// ForToken returns the plan of a token: the free plan for transient tokens, and the
+// plan it was bought under, or the default plan, for permanent tokens
+func (c *Catalog) ForToken(permanent bool, name string) *Plan {
+	if !permanent {
+		return c.Get(c.Free)
+	}
+	if plan := c.Get(name); plan != nil {
+		return plan
+	}
+	return c.Get(c.Default)
+}
+
+// Paid returns the plans which aren't free
+func (c *Catalog) Paid() []Plan {
+	var result []Plan
+	for _, plan := range c.Plans {
+		if plan.Price > 0 {
+			result = append(result, plan)
+		}
+	}
+	return result
+}
+
+// ErrInsufficientAmount is returned by ForAmount when an amount doesn't pay for any plan
+var ErrInsufficientAmount = errors.New("Transaction amount wasn't enough")
+
+// ForAmount returns the most expensive quoted plan an amount in BTC pays for, and its price in BTC
+func (c *Catalog) ForAmount(amountBtc float64, quote Quote) (*Plan, float64, error) {
+	var best *Plan
+	var bestPrice float64
+	for i, plan := range c.Plans {
+		price, ok := quote[plan.Name]
+		if !ok || plan.Price <= 0 {
+			continue
+		}
+		if price <= amountBtc && price > bestPrice {
+			best, bestPrice = &c.Plans[i], price
+		}
+	}
+	if best == nil {
+		return nil, 0, ErrInsufficientAmount
+	}
+	return best, bestPrice, nil
+}
+
+// Quote is the prices in BTC of paid plans by name, at the exchange rates of a given time
+type Quote map[string]float64
+
+// Quote returns the prices in BTC of the paid plans at the current rates, or only of plan unless nil
+func (c *Catalog) Quote(rates Rates, plan *Plan) (Quote, error) {
+	quote := make(Quote)
+	for i := range c.Plans {
+		each := &c.Plans[i]
+		if each.Price <= 0 || plan != nil && each.Name != plan.Name {
+			continue
+		}
+		price, err := PriceBtc(each, rates)
+		if err != nil {
+			return nil, err
+		}
+		quote[each.Name] = price
+	}
+	return quote, nil
+}
+
+// PriceBtc returns the price of a plan in BTC
+func PriceBtc(plan *Plan, rates Rates) (float64, error) {
+	if plan.Currency == "BTC" {
+		return plan.Price, nil
+	}
+	rate, err := rates.Rate(plan.Currency)
+	if err != nil {
+		return 0, err
+	}
+	return plan.Price * rate, nil
+}
+
+// Duration is a time.Duration which reads from JSON and YAML as "24h", "30d" or "1y"
+type Duration time.Duration
+
+// Std returns the time.Duration
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := ParseDuration(s)
+	*d = Duration(parsed)
+	return err
+}
+
+// MarshalJSON writes a duration string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalYAML parses a duration string
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	parsed, err := ParseDuration(s)
+	*d = Duration(parsed)
+	return err
+}
+
+// MarshalYAML writes a duration string
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// ParseDuration parses a time.Duration, with d for days and y for 365 days
+func ParseDuration(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "y": 365 * 24 * time.Hour} {
+		if strings.HasSuffix(s, suffix) {
+			n, err := strconv.Atoi(strings.TrimSuffix(s, suffix))
+			if err != nil {
+				return 0, errors.New("Invalid duration " + s)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,103 @@
+package plans
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rates converts prices to BTC
+type Rates interface {
+	// Rate returns the value of one unit of currency in BTC
+	Rate(currency string) (float64, error)
+}
+
+// FixedRates is a fixed table of rates, e.g. FixedRates{"USD": 0.00002}
+type FixedRates map[string]float64
+
+// Rate returns the value of one unit of currency in BTC
+func (f FixedRates) Rate(currency string) (float64, error) {
+	if currency == "BTC" {
+		return 1, nil
+	}
+	rate, ok := f[currency]
+	if !ok {
+		return 0, errors.New("No rate for " + currency)
+	}
+	return rate, nil
+}
+
+// CoinbaseURL is the default Coinbase exchange rates API URL
+const CoinbaseURL = "https://api.coinbase.com/v2/exchange-rates?currency=BTC"
+
+// CoinbaseRates gets rates from Coinbase, and caches them
+type CoinbaseRates struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	mutex   sync.Mutex
+	rates   map[string]float64
+	fetched time.Time
+}
+
+// NewCoinbaseRates returns rates fetched from url at most once per ttl
+func NewCoinbaseRates(url string, ttl time.Duration) *CoinbaseRates {
+	return &CoinbaseRates{url: url, ttl: ttl, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Rate returns the value of one unit of currency in BTC
+func (c *CoinbaseRates) Rate(currency string) (float64, error) {
+	if currency == "BTC" {
+		return 1, nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.rates == nil || time.Since(c.fetched) > c.ttl {
+		if err := c.fetch(); err != nil {
+			return 0, err
+		}
+	}
+	rate, ok := c.rates[currency]
+	if !ok {
+		return 0, errors.New("No rate for " + currency)
+	}
+	return rate, nil
+}
+
+func (c *CoinbaseRates) fetch() error {
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Exchange rates: %s", resp.Status)
+	}
+
+	var result struct {
+		Data struct {
+			Rates map[string]string `json:"rates"`
+		} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+
+	// Coinbase returns units of currency per BTC
+	rates := make(map[string]float64)
+	for currency, value := range result.Data.Rates {
+		perBtc, err := strconv.ParseFloat(value, 64)
+		if err == nil && perBtc > 0 {
+			rates[currency] = 1 / perBtc
+		}
+	}
+	c.rates = rates
+	c.fetched = time.Now()
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 
 	"strconv"
 
+	"ezcp.io/ezcp-server/jobs"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -43,6 +44,11 @@ func (w *wrappedResponseWriter) WriteHeader(status int) {
 func (w *wrappedResponseWriter) Write(bytes []byte) (int, error) {
 	return w.res.Write(bytes)
 }
+func (w *wrappedResponseWriter) Flush() {
+	if flusher, ok := w.res.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
 
 // hitCounter adds a counter to this route, which monitors hits and response codes
 func hitCounter(host string, route string, f func(res http.ResponseWriter, req *http.Request)) func(res http.ResponseWriter, req *http.Request) {
@@ -54,6 +60,9 @@ func hitCounter(host string, route string, f func(res http.ResponseWriter, req *
 	return func(res http.ResponseWriter, req *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err) // let net/http abort the connection
+				}
 				log.Print("recovered error ", err)
 				panicCounter.Inc()
 			}
@@ -65,4 +74,5 @@ func hitCounter(host string, route string, f func(res http.ResponseWriter, req *
 func registerPrometheus() {
 	prometheus.MustRegister(routesCounter)
 	prometheus.MustRegister(panicsCounter)
+	jobs.RegisterPrometheus()
 }
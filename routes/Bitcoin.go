@@ -1,20 +1,97 @@
 package routes
 
-import "net/http"
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"ezcp.io/ezcp-server/db"
+	"ezcp.io/ezcp-server/plans"
+	"ezcp.io/ezcp-server/tokens"
+)
+
+const (
+	// claimSecretHeader carries the secret needed to claim the token paid to an address
+	claimSecretHeader = "X-Ezcp-Claim-Secret"
+
+	// priceHeader carries the price in BTC of the plan chosen with an address
+	priceHeader = "X-Ezcp-Price-Btc"
+
+	// quoteExpiresHeader carries when the prices quoted with an address stop holding
+	quoteExpiresHeader = "X-Ezcp-Quote-Expires"
+)
 
 // Bitcoin returns a new bitcoin address
+// The token paid to it is returned by POST /token/{tx}, unless asked with ?claim=true: then it can only be
+// claimed with the secret returned in the X-Ezcp-Claim-Secret header, as transaction IDs are public.
+// With ?plan=name, the payment must be at least the price returned in the X-Ezcp-Price-Btc header,
+// otherwise it buys the most expensive plan it pays for.
+// Prices are quoted at the current exchange rates, and hold for payments made before X-Ezcp-Quote-Expires.
+// With ?token=..., the payment renews that permanent token instead of minting a new one, and is always claimed.
 func (h *Handler) Bitcoin(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
 	if req.Method != http.MethodPost {
 		res.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	address, err := h.db.NewAddress()
+	name := req.URL.Query().Get("plan")
+	var plan *plans.Plan
+	if name != "" {
+		plan = h.settings.Plans.Get(name)
+		if plan == nil || plan.Price == 0 {
+			res.WriteHeader(400)
+			res.Write([]byte("Unknown plan"))
+			return
+		}
+	}
+	quote, err := h.settings.Plans.Quote(h.settings.Rates, plan)
 	if err != nil {
 		h.internalError(res, err)
 		return
 	}
+	quoted := time.Now()
 
+	renews := req.URL.Query().Get("token")
+	if renews != "" {
+		tok, err := h.db.GetToken(ctx, renews)
+		if err != nil {
+			h.internalError(res, err)
+			return
+		}
+		if tok == nil || !tok.Permanent {
+			res.WriteHeader(404)
+			res.Write([]byte("Permanent token not found"))
+			return
+		}
+	}
+
+	address, err := h.payment.NewAddress()
+	if err != nil {
+		h.internalError(res, err)
+		return
+	}
+	var secret string
+	if req.URL.Query().Get("claim") == "true" || renews != "" {
+		secret, err = tokens.Secret()
+		if err != nil {
+			h.internalError(res, err)
+			return
+		}
+	}
+	err = h.db.StoreAddress(ctx, &db.Address{Address: address, Secret: secret, Plan: name, Renews: renews, Quote: quote, Quoted: quoted})
+	if err != nil {
+		h.internalError(res, err)
+		return
+	}
+
+	if secret != "" {
+		res.Header().Set(claimSecretHeader, secret)
+	}
+	if name != "" {
+		res.Header().Set(priceHeader, strconv.FormatFloat(quote[name], 'f', 8, 64))
+	}
+	res.Header().Set(quoteExpiresHeader, quoted.Add(h.settings.QuoteValidity).UTC().Format(http.TimeFormat))
 	res.WriteHeader(200)
 	res.Write([]byte(address))
 }
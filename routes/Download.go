@@ -1,13 +1,16 @@
 package routes
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
+	"strconv"
 	"time"
 
 	"ezcp.io/ezcp-server/db"
+	"ezcp.io/ezcp-server/storage"
 
 	"strings"
 
@@ -15,26 +18,33 @@ import (
 )
 
 // Download is used to retrieve the file from the CLI
+// Interrupted downloads can be resumed with Range requests: the file is deleted
+// once every byte has been delivered, or when the download grace window ends
 func (h *Handler) Download(res http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodGet {
+	ctx := req.Context()
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
 		res.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
 	token := mux.Vars(req)["token"]
 
+	// the home page decrypts envelopes, it downloads them from the token's API host
+	res.Header().Set("Access-Control-Allow-Origin", "*")
+	res.Header().Set("Access-Control-Expose-Headers", "X-Ezcp-Envelope, X-Checksum-SHA256")
+
 	hostName := req.Host
 	if last := strings.LastIndex(req.Host, ":"); last != -1 {
 		hostName = req.Host[:last]
 	}
-	expectedHostName := "api" + string(token[0]) + ".ezcp.io"
-	if hostName != expectedHostName && req.Host != "localhost:8000" {
+	expectedHostName := h.apiHost(token)
+	if hostName != expectedHostName && req.Host != h.settings.DevHost {
 		res.Header().Set("Location", "https://"+expectedHostName+"/download/"+token)
 		res.WriteHeader(301)
 		return
 	}
 
-	tok, err := h.db.GetToken(token)
+	tok, err := h.db.GetToken(ctx, token)
 	if err != nil {
 		h.internalError(res, err)
 		return
@@ -45,33 +55,137 @@ func (h *Handler) Download(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 	if tok.Uploaded == nil {
+		relay := h.relays.get(token)
+		if relay == nil && tok.UploadLength > 0 {
+			// a resumable upload between PATCHes
+			if offset, err := h.staging.Offset(token); err == nil {
+				relay = h.relays.resume(token, offset, false)
+			}
+		}
+		if relay != nil {
+			defer h.relays.pause(token, relay, false)
+			h.downloadLive(res, req, tok, relay)
+			return
+		}
 		res.WriteHeader(400)
 		res.Write([]byte("Token not uploaded"))
 		return
 	}
 
-	file, err := os.Open(db.GetFilePath(token))
+	// the download stops reading the storage when the client is gone
+	file, err := storage.WithContext(ctx, h.storage).Get(token)
 	if err != nil {
 		h.internalError(res, err)
 		return
 	}
 	defer file.Close()
 
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		h.internalError(res, err)
+		return
+	}
+
+	// ServeContent handles Range, If-Range, Content-Length and conditional requests
+	counter := &countingResponseWriter{ResponseWriter: res}
 	res.Header().Set("Content-Type", "application/octet-stream")
-	res.WriteHeader(200)
-	_, err = io.Copy(res, file)
+	res.Header().Set("ETag", `"`+strconv.FormatInt(tok.Uploaded.UnixNano(), 36)+`"`)
+	setDigest(res.Header(), tok.SHA256)
+	if tok.Envelope != "" {
+		res.Header().Set("X-Ezcp-Envelope", tok.Envelope)
+	}
+	http.ServeContent(counter, req, "", *tok.Uploaded, file)
+
+	if req.Method == http.MethodHead {
+		return
+	}
+	var start int64
+	switch counter.status {
+	case http.StatusOK:
+	case http.StatusPartialContent:
+		var end int64
+		if _, err := fmt.Sscanf(res.Header().Get("Content-Range"), "bytes %d-%d/", &start, &end); err != nil {
+			return // multipart/byteranges
+		}
+	default:
+		return
+	}
+
+	finished := h.deliveries.add(token, size, start, start+counter.written, func() {
+		log.Print("Download grace window expired ", token)
+		h.downloaded(context.Background(), tok) // the request is over
+	})
+	if finished {
+		h.downloaded(ctx, tok)
+	}
+}
+
+// downloadLive streams a file while it is being uploaded
+// If the upload fails, the connection is aborted so the client doesn't mistake a truncated file for a complete one
+func (h *Handler) downloadLive(res http.ResponseWriter, req *http.Request, tok *db.Token, relay *relay) {
+	ctx := req.Context()
+	file, err := h.staging.Open(tok.Token)
 	if err != nil {
-		log.Print("Error during copy from disk")
+		h.internalError(res, err)
 		return
 	}
+	defer file.Close()
 
-	err = h.db.TokenDownloaded(tok, time.Now())
+	res.Header().Set("Content-Type", "application/octet-stream")
+	if req.Method == http.MethodHead {
+		res.WriteHeader(200)
+		return
+	}
+
+	// the digest is known once the upload completes, it's sent in trailers
+	res.Header().Set("Trailer", "Digest, X-Checksum-SHA256")
+	err = relay.follow(ctx, res, file)
+	if err == errRelayBusy {
+		res.WriteHeader(409)
+		res.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		log.Print("Live download failed ", tok.Token, err)
+		panic(http.ErrAbortHandler)
+	}
+	// reloaded now the upload is complete, so its plan and state decide what happens to the file
+	uploaded, err := h.db.GetToken(ctx, tok.Token)
 	if err != nil {
-		log.Print("Can't remove token", token, err)
+		log.Print("Can't reload token ", tok.Token, " after its live download: ", err)
+		uploaded = tok
+	}
+	if uploaded == nil {
+		return // removed meanwhile
+	}
+	setDigest(res.Header(), uploaded.SHA256)
+	h.downloaded(ctx, uploaded)
+}
+
+// downloaded is called once the file has been delivered, the file is deleted
+// after the number of downloads allowed by the token's plan
+func (h *Handler) downloaded(ctx context.Context, tok *db.Token) {
+	plan := h.plan(tok)
+	last := plan.MaxDownloads > 0 && tok.Downloads+1 >= plan.MaxDownloads
+
+	var err error
+	switch {
+	case !last:
+		err = h.db.TokenDownloaded(ctx, tok, time.Now())
+	case tok.Permanent:
+		err = h.db.TokenCleared(ctx, tok.Token)
+	default:
+		err = h.db.RemoveToken(ctx, tok.Token)
+	}
+	if err != nil {
+		log.Print("Can't update token ", tok.Token, err)
+	}
+	if !last {
+		return
 	}
 
-	err = os.Remove(db.GetFilePath(token))
+	err = h.storage.Delete(tok.Token)
 	if err != nil {
-		log.Print("Can't remove file ", token, err)
+		log.Print("Can't remove file ", tok.Token, err)
 	}
 }
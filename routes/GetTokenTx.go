@@ -1,14 +1,21 @@
 package routes
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 
 	"ezcp.io/ezcp-server/db"
+	"ezcp.io/ezcp-server/plans"
 	"github.com/gorilla/mux"
 )
 
 // GetTokenTx returns a permanent token
+// Transactions paying to an address from /bitcoin are settled for the plan chosen with the address,
+// or renew its token. The token of an address with a claim secret is only returned by the claim:
+// transaction IDs are public.
 func (h *Handler) GetTokenTx(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
 	txhash := mux.Vars(req)["tx"]
 
 	if req.Method != http.MethodPost {
@@ -18,36 +25,57 @@ func (h *Handler) GetTokenTx(res http.ResponseWriter, req *http.Request) {
 	var err error
 	var tx *db.Transaction
 
-	tx, err = h.db.LoadTransaction(txhash)
+	tx, err = h.db.LoadTransaction(ctx, txhash)
 	if err != nil {
 		h.internalError(res, err)
 		return
 	}
 
 	if tx == nil { // not in cache
-		tx, err = h.db.BitgoTransaction(txhash)
+		tx, err = h.payment.LookupTransaction(txhash)
 		if err != nil {
 			h.internalError(res, err)
 			return
 		}
-
-		// check tx
-		if err := tx.Check(); err != nil {
-			res.WriteHeader(401)
-			res.Write([]byte(err.Error()))
+		if tx == nil {
+			res.WriteHeader(404)
+			res.Write([]byte("Transaction not found"))
 			return
 		}
 
-		// not in cache also means no token yet
-		_tok := h.getToken(req)
-		err = h.db.CreateDurableToken(_tok, txhash)
+		address, err := h.paidAddress(ctx, tx)
 		if err != nil {
 			h.internalError(res, err)
 			return
 		}
-		tx.Token = &_tok
+		if address != nil {
+			address, err = h.settle(ctx, tx, false, address)
+			switch {
+			case isInvalidPayment(err):
+				res.WriteHeader(401)
+				res.Write([]byte(err.Error()))
+			case err != nil:
+				h.internalError(res, err)
+			case address.Token == "":
+				res.WriteHeader(202)
+				res.Write([]byte(fmt.Sprintf("%s (%d/%d)", db.ErrPending, tx.Confirmations, h.settings.MinConfirmations)))
+			case address.Secret != "":
+				claimRequired(res, address.Address)
+			default:
+				res.WriteHeader(201)
+				res.Write([]byte(address.Token))
+			}
+			return
+		}
 
-		err := h.db.StoreTransaction(tx) // put in cache
+		// check tx, pending transactions aren't cached so they're checked again next time
+		plan := h.checkTransaction(ctx, res, tx)
+		if plan == nil {
+			return
+		}
+
+		// not in cache also means no token yet
+		tx, err = h.issueToken(ctx, tx, plan)
 		if err != nil {
 			h.internalError(res, err)
 			return
@@ -57,12 +85,70 @@ func (h *Handler) GetTokenTx(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// check tx, it could have expired
-	if err := tx.Check(); err != nil {
-		res.WriteHeader(401)
-		res.Write([]byte(err.Error()))
+	if tx.Address != "" {
+		claimRequired(res, tx.Address)
+		return
+	}
+
+	// check tx, it could have expired or been revoked
+	if h.checkTransaction(ctx, res, tx) == nil {
 		return
 	}
 	res.WriteHeader(200)
 	res.Write([]byte(*tx.Token))
 }
+
+// claimRequired answers a request for the token of a transaction paid to an address from /bitcoin
+func claimRequired(res http.ResponseWriter, address string) {
+	res.WriteHeader(403)
+	res.Write([]byte("Claim the token with GET /claim/" + address + " and the claim secret of the address"))
+}
+
+// checkTransaction checks a transaction and returns the plan it pays for,
+// or writes the error response and returns nil
+func (h *Handler) checkTransaction(ctx context.Context, res http.ResponseWriter, tx *db.Transaction) *plans.Plan {
+	plan, err := h.checkPayment(ctx, tx, nil, h.settings.MinConfirmations)
+	if err == db.ErrPending {
+		res.WriteHeader(202)
+		res.Write([]byte(fmt.Sprintf("%s (%d/%d)", err, tx.Confirmations, h.settings.MinConfirmations)))
+		return nil
+	}
+	if isInvalidPayment(err) {
+		res.WriteHeader(401)
+		res.Write([]byte(err.Error()))
+		return nil
+	}
+	if err != nil {
+		h.internalError(res, err)
+		return nil
+	}
+	return plan
+}
+
+// issueToken creates the permanent token of a checked transaction paying for plan, and caches the transaction.
+// If the transaction was cached concurrently, the cached one is returned.
+func (h *Handler) issueToken(ctx context.Context, tx *db.Transaction, plan *plans.Plan) (*db.Transaction, error) {
+	token, err := h.newToken(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	expires := tx.GetDate().Add(plan.Duration.Std())
+	err = h.db.CreateDurableToken(ctx, token, tx.ID, plan.Name, expires)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := expires.Add(db.ExpiredRetention) // kept as long as its token
+	tx.Token = &token
+	tx.Plan = plan.Name
+	tx.ExpiresAt = &expiresAt
+
+	err = h.db.StoreTransaction(ctx, tx) // put in cache
+	if db.IsDuplicate(err) {
+		h.db.RemoveToken(ctx, token)
+		return h.db.LoadTransaction(ctx, tx.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
@@ -1,17 +1,15 @@
 package routes
 
 import (
-	"crypto/sha1"
-	"errors"
-	"fmt"
+	"context"
 	"log"
-	"math/rand"
 	"net/http"
-	"strconv"
-	"time"
+
+	"ezcp.io/ezcp-server/tokens"
 )
 
 // Root serves the home page
+// The page gets its token from the API, so crawlers don't create tokens
 func (h *Handler) Root(res http.ResponseWriter, req *http.Request) {
 
 	if req.Method != http.MethodGet && req.Method != http.MethodHead {
@@ -21,42 +19,23 @@ func (h *Handler) Root(res http.ResponseWriter, req *http.Request) {
 
 	res.Header().Set("Content-type", "text/html")
 	res.WriteHeader(200)
-	hash := h.getToken(req)
-
-	exists, err := h.db.TokenExists(hash, false)
-	if err != nil {
-		h.internalError(res, err)
-	}
-	if exists {
-		h.internalError(res, errors.New("SHA1 collision"))
-	}
-
-	err = h.db.CreateToken(hash)
-	if err != nil {
-		h.internalError(res, err)
+	if req.Method == http.MethodHead {
+		return
 	}
-	vars := struct {
-		Token string
-	}{hash}
 
-	err = h.homeTemplate.Execute(res, vars)
+	err := h.homeTemplate.Execute(res, nil)
 	if err != nil {
 		log.Print(err)
 	}
 }
 
-func (h *Handler) getToken(req *http.Request) string {
-	now := time.Now().String()
-	now2 := strconv.Itoa(time.Now().Nanosecond())
-	random := strconv.Itoa(rand.Int())
-	useragent := req.UserAgent()
-
-	sha1 := sha1.New()
-	sha1.Write([]byte(now))
-	sha1.Write([]byte(now2))
-	sha1.Write([]byte(random))
-	sha1.Write([]byte(useragent))
-	bytes := sha1.Sum(nil)
-	hash := fmt.Sprintf("%x", bytes)
-	return hash
+// newToken generates a token which isn't in the database yet, permanent tokens can't be words
+func (h *Handler) newToken(ctx context.Context, permanent bool) (string, error) {
+	generator := h.generator
+	if permanent {
+		generator = tokens.Durable(generator)
+	}
+	return tokens.New(generator, func(token string) (bool, error) {
+		return h.db.TokenExists(ctx, token, false)
+	})
 }
@@ -1,29 +1,53 @@
 package routes
 
 import (
+	"context"
+	"encoding/hex"
 	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
-	"os"
 	"time"
 
 	"ezcp.io/ezcp-server/db"
-
-	"errors"
-
+	"ezcp.io/ezcp-server/storage"
 	"github.com/gorilla/mux"
 )
 
 // Upload is used to receive a post'ed document from the CLI
 // It stores the resulting file
+// Resumable uploads using the tus protocol are handled too
 func (h *Handler) Upload(res http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodPost {
+	ctx := req.Context()
+	h.uploads.Add(1)
+	defer h.uploads.Done()
+
+	switch req.Method {
+	case http.MethodOptions:
+		h.tusOptions(res, req)
+		return
+	case http.MethodHead:
+		h.tusHead(res, req)
+		return
+	case http.MethodPatch:
+		h.tusPatch(res, req)
+		return
+	case http.MethodDelete:
+		h.tusDelete(res, req)
+		return
+	case http.MethodPost:
+		if req.Header.Get("Tus-Resumable") != "" {
+			h.tusCreate(res, req)
+			return
+		}
+	default:
 		res.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
 	token := mux.Vars(req)["token"]
 
-	tok, err := h.db.GetToken(token)
+	tok, err := h.db.GetToken(ctx, token)
 	if err != nil {
 		h.internalError(res, err)
 		return
@@ -38,32 +62,111 @@ func (h *Handler) Upload(res http.ResponseWriter, req *http.Request) {
 		res.Write([]byte("Token already uploaded"))
 		return
 	}
+	if !h.checkExpiry(ctx, res, tok) {
+		return
+	}
 
-	file, err := os.Create(db.GetFilePath(token))
+	// refuse what can be refused before reading the body
+	expected, err := expectedChecksums(req.Header)
 	if err != nil {
-		h.internalError(res, err)
+		res.WriteHeader(400)
+		res.Write([]byte(err.Error()))
+		return
+	}
+	max := h.plan(tok).MaxSize()
+	if req.ContentLength > max {
+		uploadRefused(res, errTooLarge, max)
+		return
+	}
+	needed := req.ContentLength
+	if needed < 0 {
+		needed = max
+	}
+	if err = h.checkSpace(needed); err != nil {
+		if !uploadRefused(res, err, max) {
+			h.internalError(res, err)
+		}
 		return
 	}
-	defer file.Close()
 
-	var size int64
-	size, err = io.Copy(file, req.Body)
+	// the upload goes through the staging area, where it can be downloaded live.
+	// It stays locked until complete, so another upload to the token is refused.
+	partial, err := h.staging.CreateWriter(token)
+	if err == storage.ErrBusy {
+		res.WriteHeader(409)
+		res.Write([]byte(err.Error()))
+		return
+	}
 	if err != nil {
 		h.internalError(res, err)
 		return
 	}
 
-	if !tok.IsValidSize(size) {
-		os.Remove(db.GetFilePath(token))
-		h.internalError(res, errors.New("File too large"))
-		return
+	relay := h.relays.start(token)
+	size, err := io.Copy(relay.writer(partial), newSizeLimiter(req.Body, max))
+	if err == nil {
+		err = h.complete(ctx, token, size, expected)
 	}
-
-	err = h.db.TokenUploaded(token, size, time.Now())
+	h.relays.stop(token, relay, err)
+	partial.Discard()
 	if err != nil {
-		h.internalError(res, err)
+		h.uploadFailed(token)
+		if !uploadRefused(res, err, max) {
+			h.internalError(res, err)
+		}
 		return
 	}
 
 	res.WriteHeader(201)
 }
+
+// uploadFailed records an interrupted upload failed, its partial file must have been discarded.
+// The request's context is done when the client or the server closed the connection.
+func (h *Handler) uploadFailed(token string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := h.db.TokenUploadFailed(ctx, token, time.Now()); err != nil && err != db.ErrNotFound {
+		log.Print("Can't record failed upload ", token, err)
+	}
+}
+
+// complete moves a complete upload from the staging area to the storage and marks the token uploaded.
+// It is copied instead when the storage can't take it over, e.g. it encrypts files or isn't local.
+// The caller holds the partial upload, and discards it once complete.
+// The file only replaces the previous one, of a permanent token, once the token is marked uploaded.
+// Its SHA-256 is computed on the way, and the upload is refused if it doesn't match the expected checksums.
+// Files encrypted by the client are labelled with their envelope.
+func (h *Handler) complete(ctx context.Context, token string, length int64, expected *checksums) error {
+	file, err := h.staging.Open(token)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hasher := newHasher(expected)
+	sniffer := &envelopeSniffer{r: file}
+	var pending storage.Pending
+	if mover, ok := h.storage.(storage.Mover); ok {
+		// the checksums need a read, but the file isn't written again
+		if _, err = io.Copy(ioutil.Discard, hasher.reader(sniffer)); err != nil {
+			return err
+		}
+		file.Close()
+		pending, _, err = h.staging.MoveTo(mover, token)
+	} else {
+		pending, _, err = h.storage.Prepare(token, hasher.reader(sniffer))
+	}
+	if err != nil {
+		return err
+	}
+	actual := hasher.sums()
+	if err = expected.verify(actual); err != nil {
+		pending.Abort()
+		return err
+	}
+	if err = h.db.TokenUploaded(ctx, token, length, hex.EncodeToString(actual.sha256), sniffer.label(), time.Now()); err != nil {
+		pending.Abort()
+		return err
+	}
+	return pending.Commit()
+}
@@ -0,0 +1,163 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"ezcp.io/ezcp-server/db"
+	"ezcp.io/ezcp-server/storage"
+	"github.com/gorilla/mux"
+)
+
+// apiToken is the JSON representation of a token
+type apiToken struct {
+	Token      string     `json:"token"`
+	Permanent  bool       `json:"permanent"`
+	Plan       string     `json:"plan"`
+	Status     string     `json:"status"` // waiting, uploading, uploaded or failed
+	Size       int64      `json:"size"`
+	SHA256     string     `json:"sha256,omitempty"`
+	Envelope   string     `json:"envelope,omitempty"` // set when encrypted by the client
+	Created    time.Time  `json:"created"`
+	Uploaded   *time.Time `json:"uploaded,omitempty"`
+	Downloaded *time.Time `json:"downloaded,omitempty"`
+	Failed     *time.Time `json:"failed,omitempty"`
+	Expires    *time.Time `json:"expires,omitempty"`
+}
+
+// apiError is the JSON body of every API error
+type apiError struct {
+	Status int    `json:"status"`
+	Error  string `json:"error"`
+}
+
+// APITokens handles /api/v1/tokens, POST creates a new transient token
+func (h *Handler) APITokens(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if req.Method != http.MethodPost {
+		h.apiError(res, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	token, err := h.newToken(ctx, false)
+	if err != nil {
+		h.apiInternalError(res, err)
+		return
+	}
+	free := h.settings.Plans.Get(h.settings.Plans.Free)
+	err = h.db.CreateToken(ctx, token, free.Retention.Std())
+	if err != nil {
+		h.apiInternalError(res, err)
+		return
+	}
+
+	tok, err := h.db.GetToken(ctx, token)
+	if err != nil {
+		h.apiInternalError(res, err)
+		return
+	}
+	h.apiTokenResponse(ctx, res, 201, tok)
+}
+
+// APIToken handles /api/v1/tokens/{token}, GET returns the token status and DELETE removes it.
+// Deleting a permanent token only removes its file.
+func (h *Handler) APIToken(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if req.Method != http.MethodGet && req.Method != http.MethodDelete {
+		h.apiError(res, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	token := mux.Vars(req)["token"]
+	tok, err := h.db.GetToken(ctx, token)
+	if err != nil {
+		h.apiInternalError(res, err)
+		return
+	}
+	if tok == nil {
+		h.apiError(res, 404, "Token not found")
+		return
+	}
+
+	if req.Method == http.MethodGet {
+		h.apiTokenResponse(ctx, res, 200, tok)
+		return
+	}
+
+	if tok.Permanent {
+		err = h.db.TokenCleared(ctx, token)
+	} else {
+		err = h.db.RemoveToken(ctx, token)
+	}
+	if err != nil {
+		h.apiInternalError(res, err)
+		return
+	}
+	if err = h.storage.Delete(token); err != nil && err != storage.ErrNotFound {
+		log.Print("Can't remove file ", token, err)
+	}
+	if err = h.staging.Remove(token); err != nil && err != storage.ErrNotFound {
+		log.Print("Can't remove partial upload ", token, err)
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) apiTokenResponse(ctx context.Context, res http.ResponseWriter, status int, tok *db.Token) {
+	plan := h.plan(tok)
+	result := &apiToken{
+		Token:      tok.Token,
+		Permanent:  tok.Permanent,
+		Plan:       plan.Name,
+		Status:     "waiting",
+		Size:       tok.Length,
+		SHA256:     tok.SHA256,
+		Envelope:   tok.Envelope,
+		Created:    tok.Created,
+		Uploaded:   tok.Uploaded,
+		Downloaded: tok.Downloaded,
+		Failed:     tok.Failed,
+	}
+
+	if tok.Uploaded != nil {
+		result.Status = "uploaded"
+	} else if offset, err := h.staging.Offset(tok.Token); err == nil {
+		result.Status = "uploading"
+		result.Size = offset
+	} else if tok.Failed != nil {
+		result.Status = "failed"
+	}
+
+	if tok.Permanent {
+		expires, err := h.expiry(ctx, tok)
+		if err != nil {
+			h.apiInternalError(res, err)
+			return
+		}
+		result.Expires = &expires
+	} else {
+		// the retention of the plan when the token was created
+		result.Expires = tok.ExpiresAt
+	}
+
+	h.apiResponse(res, status, result)
+}
+
+func (h *Handler) apiResponse(res http.ResponseWriter, status int, body interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	if err := json.NewEncoder(res).Encode(body); err != nil {
+		log.Print(err)
+	}
+}
+
+func (h *Handler) apiError(res http.ResponseWriter, status int, message string) {
+	h.apiResponse(res, status, &apiError{status, message})
+}
+
+func (h *Handler) apiInternalError(res http.ResponseWriter, err error) {
+	log.Print(err)
+	h.apiError(res, 500, err.Error())
+}
@@ -0,0 +1,110 @@
+package routes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"ezcp.io/ezcp-server/plans"
+	"ezcp.io/ezcp-server/tokens"
+)
+
+// status returns the API status of token, and expects a 200
+func (x *transferTest) status(token string) *apiToken {
+	x.t.Helper()
+	res := x.do(http.MethodGet, "/api/v1/tokens/"+token, nil, nil)
+	if res.Header.Get("Content-Type") != "application/json" {
+		x.t.Errorf("Content-Type = %q", res.Header.Get("Content-Type"))
+	}
+	var tok apiToken
+	if err := json.Unmarshal([]byte(x.expect(res, 200, "")), &tok); err != nil {
+		x.t.Fatal(err)
+	}
+	return &tok
+}
+
+func TestAPICreate(t *testing.T) {
+	x := newTransferTest(t)
+	res := x.do(http.MethodPost, "/api/v1/tokens", nil, nil)
+	var created apiToken
+	if err := json.Unmarshal([]byte(x.expect(res, 201, "")), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Token == "" || created.Permanent || created.Plan != "free" || created.Status != "waiting" ||
+		created.Expires == nil || created.Expires.Sub(created.Created) != time.Hour {
+		t.Errorf("created %+v", created)
+	}
+	stored, _ := x.db.GetToken(background, created.Token)
+	if stored == nil || !stored.ExpiresAt.Equal(*created.Expires) {
+		t.Fatalf("stored %+v", stored)
+	}
+
+	// the token is deleted when it was scheduled, whatever the retention of the plan is now
+	x.handler.settings.Plans.Plans[0].Retention = plans.Duration(2 * time.Hour)
+	if tok := x.status(created.Token); !tok.Expires.Equal(*stored.ExpiresAt) {
+		t.Errorf("expires %v, stored %v", tok.Expires, stored.ExpiresAt)
+	}
+
+	x.expect(x.do(http.MethodGet, "/api/v1/tokens", nil, nil), http.StatusMethodNotAllowed, `"status":405`)
+	x.expect(x.do(http.MethodPut, "/api/v1/tokens/"+created.Token, nil, nil), http.StatusMethodNotAllowed, "")
+}
+
+func TestAPIStatus(t *testing.T) {
+	x := newTransferTest(t)
+	token := x.token()
+	x.expect(x.tusCreate(token, 12), 201, "")
+	x.expect(x.tusPatch(token, 0, "hello, ", ""), http.StatusNoContent, "")
+	if tok := x.status(token); tok.Status != "uploading" || tok.Size != 7 || tok.Uploaded != nil {
+		t.Errorf("uploading %+v", tok)
+	}
+
+	x.expect(x.tusPatch(token, 7, "world", ""), http.StatusNoContent, "")
+	sum := sha256.Sum256([]byte("hello, world"))
+	tok := x.status(token)
+	if tok.Status != "uploaded" || tok.Size != 12 || tok.SHA256 != hex.EncodeToString(sum[:]) || tok.Uploaded == nil {
+		t.Errorf("uploaded %+v", tok)
+	}
+
+	x.expect(x.do(http.MethodDelete, "/api/v1/tokens/"+token, nil, nil), http.StatusNoContent, "")
+	res := x.do(http.MethodGet, "/api/v1/tokens/"+token, nil, nil)
+	var failure apiError
+	json.Unmarshal([]byte(x.expect(res, 404, "")), &failure)
+	if failure.Status != 404 || failure.Error != "Token not found" {
+		t.Errorf("deleted token = %+v", failure)
+	}
+}
+
+func TestAPIPermanent(t *testing.T) {
+	x := newTransferTest(t)
+	token := x.permanent("permanent")
+	x.upload(token, "hello")
+	tok := x.status(token)
+	if !tok.Permanent || tok.Plan != "premium" || tok.Status != "uploaded" || tok.Expires == nil {
+		t.Errorf("permanent %+v", tok)
+	}
+
+	// deleting a permanent token only removes its file
+	x.expect(x.do(http.MethodDelete, "/api/v1/tokens/"+token, nil, nil), http.StatusNoContent, "")
+	if tok = x.status(token); tok.Status != "waiting" || tok.Uploaded != nil {
+		t.Errorf("cleared %+v", tok)
+	}
+	x.expect(x.do(http.MethodGet, "/download/"+token, nil, nil), 400, "Token not uploaded")
+}
+
+func TestAPIWordsTokens(t *testing.T) {
+	x := newTransferTest(t)
+	x.handler.generator, _ = tokens.NewGenerator("words")
+	if token := x.token(); strings.Count(token, "-") != 2 {
+		t.Errorf("transient token %q isn't words", token)
+	}
+
+	// words are too easy to guess for a permanent token
+	token, err := x.handler.newToken(background, true)
+	if err != nil || len(token) != 40 || strings.Contains(token, "-") {
+		t.Errorf("permanent token = %q, %v", token, err)
+	}
+}
@@ -0,0 +1,123 @@
+package routes
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// errChecksumMismatch is returned when an upload doesn't match the checksums sent by the client
+var errChecksumMismatch = errors.New("Checksum mismatch")
+
+// checksums are the digests of a file, nil when unknown
+type checksums struct {
+	sha256 []byte
+	md5    []byte
+}
+
+// expectedChecksums parses the checksums of a request's body from the Digest (RFC 3230),
+// Content-MD5 and X-Checksum-SHA256 (hex or base64) headers
+func expectedChecksums(header http.Header) (*checksums, error) {
+	result := &checksums{}
+	var err error
+	for _, each := range strings.Split(header.Get("Digest"), ",") {
+		parts := strings.SplitN(strings.TrimSpace(each), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch strings.ToLower(parts[0]) {
+		case "sha-256":
+			result.sha256, err = decodeChecksum(parts[1], sha256.Size)
+		case "md5":
+			result.md5, err = decodeChecksum(parts[1], md5.Size)
+		}
+		if err != nil {
+			return nil, errors.New("Invalid Digest")
+		}
+	}
+	if value := header.Get("Content-MD5"); value != "" {
+		if result.md5, err = decodeChecksum(value, md5.Size); err != nil {
+			return nil, errors.New("Invalid Content-MD5")
+		}
+	}
+	if value := header.Get("X-Checksum-SHA256"); value != "" {
+		if result.sha256, err = decodeChecksum(value, sha256.Size); err != nil {
+			return nil, errors.New("Invalid X-Checksum-SHA256")
+		}
+	}
+	return result, nil
+}
+
+// decodeChecksum decodes a hex or base64 digest of size bytes
+func decodeChecksum(value string, size int) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	decoded, err := hex.DecodeString(value)
+	if err != nil || len(decoded) != size {
+		decoded, err = base64.StdEncoding.DecodeString(value)
+	}
+	if err == nil && len(decoded) != size {
+		err = errors.New("Invalid checksum length")
+	}
+	return decoded, err
+}
+
+// hasher computes the checksums of what is read through it: always SHA-256,
+// and MD5 only if it is expected
+type hasher struct {
+	sha256 hash.Hash
+	md5    hash.Hash
+}
+
+func newHasher(expected *checksums) *hasher {
+	h := &hasher{sha256: sha256.New()}
+	if expected != nil && expected.md5 != nil {
+		h.md5 = md5.New()
+	}
+	return h
+}
+
+func (h *hasher) reader(r io.Reader) io.Reader {
+	if h.md5 != nil {
+		return io.TeeReader(r, io.MultiWriter(h.sha256, h.md5))
+	}
+	return io.TeeReader(r, h.sha256)
+}
+
+func (h *hasher) sums() *checksums {
+	result := &checksums{sha256: h.sha256.Sum(nil)}
+	if h.md5 != nil {
+		result.md5 = h.md5.Sum(nil)
+	}
+	return result
+}
+
+// verify returns errChecksumMismatch if actual doesn't match the expected checksums
+func (c *checksums) verify(actual *checksums) error {
+	if c == nil {
+		return nil
+	}
+	if c.sha256 != nil && !bytes.Equal(c.sha256, actual.sha256) {
+		return errChecksumMismatch
+	}
+	if c.md5 != nil && !bytes.Equal(c.md5, actual.md5) {
+		return errChecksumMismatch
+	}
+	return nil
+}
+
+// setDigest sets the Digest and X-Checksum-SHA256 headers, or trailers, of a file's hex SHA-256
+func setDigest(header http.Header, sha256Hex string) {
+	sum, err := hex.DecodeString(sha256Hex)
+	if sha256Hex == "" || err != nil {
+		return
+	}
+	header.Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+	header.Set("X-Checksum-SHA256", sha256Hex)
+}
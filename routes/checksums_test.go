@@ -0,0 +1,69 @@
+package routes
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+func TestUploadChecksums(t *testing.T) {
+	x := newTransferTest(t)
+	token := x.token()
+	sum := sha256.Sum256([]byte("hello"))
+	digest := "sha-256=" + base64.StdEncoding.EncodeToString(sum[:])
+	wrong := sha256.Sum256([]byte("hell0"))
+
+	// a mismatch is refused, and nothing is stored
+	header := http.Header{"Digest": {"sha-256=" + base64.StdEncoding.EncodeToString(wrong[:])}}
+	x.expect(x.do(http.MethodPost, "/upload/"+token, header, "hello"), 400, errChecksumMismatch.Error())
+	if tok := x.status(token); tok.Status != "failed" {
+		t.Errorf("token = %+v after a mismatch", tok)
+	}
+	x.expect(x.do(http.MethodGet, "/download/"+token, nil, nil), 400, "Token not uploaded")
+
+	md5sum := md5.Sum([]byte("hell0"))
+	header = http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(md5sum[:])}}
+	x.expect(x.do(http.MethodPost, "/upload/"+token, header, "hello"), 400, errChecksumMismatch.Error())
+	header = http.Header{"X-Checksum-Sha256": {hex.EncodeToString(wrong[:])}}
+	x.expect(x.do(http.MethodPost, "/upload/"+token, header, "hello"), 400, errChecksumMismatch.Error())
+	header = http.Header{"Digest": {"sha-256=invalid"}}
+	x.expect(x.do(http.MethodPost, "/upload/"+token, header, "hello"), 400, "Invalid Digest")
+
+	md5sum = md5.Sum([]byte("hello"))
+	header = http.Header{"Digest": {digest + ", md5=" + base64.StdEncoding.EncodeToString(md5sum[:])}}
+	x.expect(x.do(http.MethodPost, "/upload/"+token, header, "hello"), 201, "")
+	if tok := x.status(token); tok.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("SHA256 = %q", tok.SHA256)
+	}
+
+	res := x.do(http.MethodGet, "/download/"+token, nil, nil)
+	x.expect(res, 200, "hello")
+	if res.Header.Get("Digest") != digest || res.Header.Get("X-Checksum-SHA256") != hex.EncodeToString(sum[:]) {
+		t.Errorf("Digest = %q, X-Checksum-SHA256 = %q", res.Header.Get("Digest"), res.Header.Get("X-Checksum-SHA256"))
+	}
+}
+
+func TestLiveDownloadDigest(t *testing.T) {
+	x := newTransferTest(t)
+	token := x.token()
+	upload := x.startUpload(token)
+	upload.body.Write([]byte("hello"))
+	x.waitRelay(token, 5)
+
+	// the digest isn't known before the download starts, it is sent in trailers
+	download := x.do(http.MethodGet, "/download/"+token, nil, nil)
+	if download.Header.Get("Digest") != "" {
+		t.Errorf("Digest = %q before the upload completed", download.Header.Get("Digest"))
+	}
+	upload.body.Close()
+	x.expect(<-upload.done, 201, "")
+	x.expect(download, 200, "hello")
+
+	sum := sha256.Sum256([]byte("hello"))
+	if download.Trailer.Get("Digest") != "sha-256="+base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Errorf("Digest trailer = %q", download.Trailer.Get("Digest"))
+	}
+}
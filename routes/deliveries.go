@@ -0,0 +1,111 @@
+package routes
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// deliveries tracks which byte ranges of each file have been sent, so a download
+// can be resumed with Range requests before the file is deleted
+type deliveries struct {
+	grace time.Duration
+
+	mutex   sync.Mutex
+	pending map[string]*delivery
+}
+
+type delivery struct {
+	size   int64
+	ranges [][2]int64 // sorted, non overlapping [start, end)
+	timer  *time.Timer
+}
+
+func newDeliveries(grace time.Duration) *deliveries {
+	return &deliveries{grace: grace, pending: make(map[string]*delivery)}
+}
+
+// add records that bytes [start, end) of a size bytes long file were delivered.
+// It returns true once the whole file has been delivered; otherwise expire is
+// called when the grace window started by the first delivery ends.
+func (d *deliveries) add(token string, size int64, start int64, end int64, expire func()) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	each, ok := d.pending[token]
+	if !ok || each.size != size {
+		if ok {
+			each.timer.Stop()
+		}
+		each = &delivery{size: size}
+		each.timer = time.AfterFunc(d.grace, func() {
+			if d.done(token, each) {
+				expire()
+			}
+		})
+		d.pending[token] = each
+	}
+
+	each.ranges = mergeRange(each.ranges, start, end)
+	if size == 0 || (len(each.ranges) == 1 && each.ranges[0][0] == 0 && each.ranges[0][1] >= size) {
+		each.timer.Stop()
+		delete(d.pending, token)
+		return true
+	}
+	return false
+}
+
+// done forgets about a delivery, it returns false if it had already been forgotten
+func (d *deliveries) done(token string, each *delivery) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.pending[token] != each {
+		return false
+	}
+	delete(d.pending, token)
+	return true
+}
+
+// mergeRange adds [start, end) to ranges, merging overlapping or adjacent ranges
+func mergeRange(ranges [][2]int64, start int64, end int64) [][2]int64 {
+	if end <= start {
+		return ranges
+	}
+	ranges = append(ranges, [2]int64{start, end})
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r[0] <= last[1] {
+			if r[1] > last[1] {
+				last[1] = r[1]
+			}
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	return merged
+}
+
+// countingResponseWriter counts the status and body bytes actually written to the client
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *countingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,87 @@
+package routes
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// get downloads token with a Range header, if not empty
+func (x *transferTest) get(token string, byteRange string) *http.Response {
+	x.t.Helper()
+	header := http.Header{}
+	if byteRange != "" {
+		header.Set("Range", byteRange)
+	}
+	return x.do(http.MethodGet, "/download/"+token, header, nil)
+}
+
+func TestDownloadRanges(t *testing.T) {
+	x := newTransferTest(t)
+	token := x.token()
+	x.upload(token, "hello, world")
+
+	x.expect(x.do(http.MethodHead, "/download/"+token, nil, nil), 200, "")
+	res := x.get(token, "bytes=0-4")
+	x.expect(res, http.StatusPartialContent, "hello")
+	if res.Header.Get("Content-Range") != "bytes 0-4/12" {
+		t.Errorf("Content-Range = %q", res.Header.Get("Content-Range"))
+	}
+
+	// a resumed download within the grace window doesn't count as another download
+	x.expect(x.get(token, "bytes=5-"), http.StatusPartialContent, ", world")
+	x.expect(x.get(token, ""), 404, "Token not found")
+}
+
+func TestDownloadUnsatisfiableRange(t *testing.T) {
+	x := newTransferTest(t)
+	token := x.token()
+	x.upload(token, "hello, world")
+
+	res := x.get(token, "bytes=12-")
+	x.expect(res, http.StatusRequestedRangeNotSatisfiable, "")
+	if res.Header.Get("Content-Range") != "bytes */12" {
+		t.Errorf("Content-Range = %q", res.Header.Get("Content-Range"))
+	}
+	x.expect(x.get(token, ""), 200, "hello, world")
+	x.expect(x.get(token, ""), 404, "")
+}
+
+func TestDownloadGraceExpired(t *testing.T) {
+	x := newTransferTest(t)
+	x.handler.deliveries = newDeliveries(10 * time.Millisecond)
+	token := x.token()
+	x.upload(token, "hello, world")
+
+	x.expect(x.get(token, "bytes=0-4"), http.StatusPartialContent, "hello")
+	for i := 0; i < 100; i++ {
+		if tok, _ := x.db.GetToken(background, token); tok == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	x.expect(x.get(token, "bytes=5-"), 404, "")
+}
+
+func TestDownloadPermanent(t *testing.T) {
+	x := newTransferTest(t)
+	token := x.permanent("permanent")
+	x.upload(token, "first")
+
+	// the premium plan doesn't limit downloads, the file is kept
+	for i := 0; i < 3; i++ {
+		res := x.get(token, "")
+		x.expect(res, 200, "first")
+		if res.Header.Get("ETag") == "" || res.Header.Get("X-Checksum-SHA256") == "" {
+			t.Errorf("headers = %v", res.Header)
+		}
+	}
+	tok, _ := x.db.GetToken(background, token)
+	if tok == nil || tok.Downloads != 3 {
+		t.Fatalf("token = %+v, want 3 downloads", tok)
+	}
+
+	// and a permanent token can be uploaded again
+	x.upload(token, "second")
+	x.expect(x.get(token, "bytes=1-"), http.StatusPartialContent, "econd")
+}
@@ -0,0 +1,33 @@
+package routes
+
+import (
+	"io"
+
+	"ezcp.io/ezcp-server/envelope"
+)
+
+// envelopeSniffer keeps the beginning of what is read through it, to detect envelopes
+// of files encrypted by the client. The server can't decrypt them, it only labels them.
+type envelopeSniffer struct {
+	r      io.Reader
+	prefix []byte
+}
+
+func (s *envelopeSniffer) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if missing := envelope.HeaderSize - len(s.prefix); missing > 0 {
+		if missing > n {
+			missing = n
+		}
+		s.prefix = append(s.prefix, p[:missing]...)
+	}
+	return n, err
+}
+
+// label returns the label of the envelope read, or "" if it isn't one
+func (s *envelopeSniffer) label() string {
+	if header := envelope.Detect(s.prefix); header != nil {
+		return header.Label()
+	}
+	return ""
+}
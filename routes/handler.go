@@ -1,36 +1,112 @@
 package routes
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sync"
 	"text/template"
+	"time"
 
 	db "ezcp.io/ezcp-server/db"
+	"ezcp.io/ezcp-server/payment"
+	"ezcp.io/ezcp-server/plans"
+	"ezcp.io/ezcp-server/storage"
+	"ezcp.io/ezcp-server/tokens"
 )
 
+// Settings tunes the routes
+type Settings struct {
+	// DownloadGrace is how long partially downloaded files are kept so the download can be resumed
+	DownloadGrace time.Duration
+
+	// MinConfirmations is required before issuing a permanent token
+	MinConfirmations int
+
+	// QuoteValidity is how long the BTC prices quoted by /bitcoin hold
+	QuoteValidity time.Duration
+
+	// WebhookSecret authenticates the payment provider's webhook calls
+	WebhookSecret string
+
+	// Plans are the available plans, and Rates prices them in BTC
+	Plans *plans.Catalog
+	Rates plans.Rates
+
+	// Domain is the main host name, tokens are served by its api0 to apif subdomains
+	Domain string
+
+	// DevHost is the host of the development server, which serves every token
+	DevHost string
+
+	// MinFreeSpace is the free disk space, in bytes, uploads can't go below
+	MinFreeSpace uint64
+}
+
 // Handler handles HTTP routes
 type Handler struct {
-	db           *db.DB
+	db           db.Store
+	storage      storage.Storage
+	staging      *storage.Staging
+	deliveries   *deliveries
+	relays       *relays
+	generator    tokens.Generator
+	payment      payment.Provider
 	homeTemplate *template.Template
+	settings     Settings
+
+	// uploads counts the uploads in progress, see Wait
+	uploads sync.WaitGroup
 }
 
 // NewHandler returns a routes handler
-func NewHandler(db *db.DB) *Handler {
+func NewHandler(db db.Store, storage storage.Storage, staging *storage.Staging, generator tokens.Generator, payment payment.Provider, settings Settings) *Handler {
 
 	indexHTMLFile, err := ioutil.ReadFile("index.html")
 	if err != nil {
 		panic(err)
 	}
 	tmpl, err := template.New("Home").Parse(string(indexHTMLFile))
-	handler := &Handler{db, tmpl}
+	handler := &Handler{
+		db:           db,
+		storage:      storage,
+		staging:      staging,
+		deliveries:   newDeliveries(settings.DownloadGrace),
+		relays:       newRelays(),
+		generator:    generator,
+		payment:      payment,
+		homeTemplate: tmpl,
+		settings:     settings,
+	}
 
 	return handler
 }
 
+// Wait waits until the uploads in progress have completed or failed, or ctx is done.
+// It is called on shutdown once the server is closed, so interrupted uploads are recorded.
+func (h *Handler) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.uploads.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (h *Handler) internalError(res http.ResponseWriter, err error) {
 	log.Print(err)
 
 	res.WriteHeader(500)
 	res.Write([]byte(err.Error()))
 }
+
+// apiHost returns the host name serving a token
+func (h *Handler) apiHost(token string) string {
+	return "api" + string(tokens.Shard(token)) + "." + h.settings.Domain
+}
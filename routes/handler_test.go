@@ -0,0 +1,145 @@
+package routes
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ezcp.io/ezcp-server/db"
+	"ezcp.io/ezcp-server/plans"
+	"ezcp.io/ezcp-server/storage"
+	"ezcp.io/ezcp-server/tokens"
+	"github.com/gorilla/mux"
+)
+
+// testMaxFileSize is the size limit of the free plan of transferTest, the largest upload is a byte less
+const testMaxFileSize = 64 * 1024
+
+// transferTest serves the upload, download and API routes over HTTP, with a bbolt database
+type transferTest struct {
+	t       *testing.T
+	db      *db.Bolt
+	handler *Handler
+	server  *httptest.Server
+}
+
+func newTransferTest(t *testing.T) *transferTest {
+	database, err := db.NewBolt(filepath.Join(t.TempDir(), "ezcp.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(database.Close)
+	generator, _ := tokens.NewGenerator("hex")
+
+	h := &Handler{
+		db:         database,
+		storage:    storage.NewMemory(),
+		staging:    storage.NewStaging(t.TempDir()),
+		deliveries: newDeliveries(time.Minute),
+		relays:     newRelays(),
+		generator:  generator,
+		settings: Settings{
+			Plans: &plans.Catalog{
+				Plans: []plans.Plan{
+					{Name: "free", Currency: "BTC", MaxFileSize: testMaxFileSize, Retention: plans.Duration(time.Hour), MaxDownloads: 1},
+					{Name: "premium", Price: 0.01, Currency: "BTC", Duration: plans.Duration(365 * 24 * time.Hour),
+						MaxFileSize: testMaxFileSize, Retention: plans.Duration(24 * time.Hour)},
+				},
+				Free:    "free",
+				Default: "premium",
+			},
+			Domain: "ezcp.test",
+		},
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/upload/{token}", h.Upload)
+	router.HandleFunc("/download/{token}", h.Download)
+	router.HandleFunc("/api/v1/tokens", h.APITokens)
+	router.HandleFunc("/api/v1/tokens/{token}", h.APIToken)
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	h.settings.DevHost = server.Listener.Addr().String()
+	return &transferTest{t, database, h, server}
+}
+
+// do sends a request to the server, body is a string, an io.Reader or nil
+func (x *transferTest) do(method string, path string, header http.Header, body interface{}) *http.Response {
+	x.t.Helper()
+	var reader io.Reader
+	switch each := body.(type) {
+	case string:
+		reader = strings.NewReader(each)
+	case io.Reader:
+		reader = each
+	}
+	req, err := http.NewRequest(method, x.server.URL+path, reader)
+	if err != nil {
+		x.t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	res, err := x.server.Client().Do(req)
+	if err != nil {
+		x.t.Fatal(err)
+	}
+	return res
+}
+
+// expect checks the status of a response, and that its body contains want, and returns the body
+func (x *transferTest) expect(res *http.Response, status int, want string) string {
+	x.t.Helper()
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || res.StatusCode != status || !strings.Contains(string(body), want) {
+		x.t.Fatalf("got %d %q, %v, want %d %q", res.StatusCode, body, err, status, want)
+	}
+	return string(body)
+}
+
+// token creates a transient token with the API
+func (x *transferTest) token() string {
+	x.t.Helper()
+	var tok apiToken
+	json.Unmarshal([]byte(x.expect(x.do(http.MethodPost, "/api/v1/tokens", nil, nil), 201, "")), &tok)
+	return tok.Token
+}
+
+// permanent creates a permanent token, of the premium plan
+func (x *transferTest) permanent(token string) string {
+	x.t.Helper()
+	if err := x.db.CreateDurableToken(background, token, "tx", "premium", time.Now().Add(time.Hour)); err != nil {
+		x.t.Fatal(err)
+	}
+	return token
+}
+
+// upload uploads data to token, and expects a 201
+func (x *transferTest) upload(token string, data string) {
+	x.t.Helper()
+	x.expect(x.do(http.MethodPost, "/upload/"+token, nil, data), 201, "")
+}
+
+// waitRelay waits until an upload to token in progress has written bytes to the staging area
+func (x *transferTest) waitRelay(token string, written int64) {
+	x.t.Helper()
+	for i := 0; i < 1000; i++ {
+		if relay := x.handler.relays.get(token); relay != nil {
+			relay.mutex.Lock()
+			done := relay.written >= written
+			relay.mutex.Unlock()
+			if done {
+				return
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+	x.t.Fatalf("the upload didn't write %d bytes", written)
+}
@@ -0,0 +1,108 @@
+package routes
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"ezcp.io/ezcp-server/storage"
+)
+
+var (
+	// errTooLarge is returned when an upload exceeds its size limit
+	errTooLarge = errors.New("File too large")
+
+	// errLowSpace is returned when there isn't enough free disk space for an upload
+	errLowSpace = errors.New("Not enough disk space, try again later")
+)
+
+// sizeLimiter reads at most max bytes, and fails with errTooLarge if there are more
+type sizeLimiter struct {
+	r         io.Reader
+	remaining int64
+}
+
+func newSizeLimiter(r io.Reader, max int64) *sizeLimiter {
+	return &sizeLimiter{r, max}
+}
+
+func (l *sizeLimiter) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errTooLarge
+	}
+	// read one byte more than allowed, to tell the end of the body from an excess
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n + int(l.remaining), errTooLarge
+	}
+	return n, err
+}
+
+// checkSpace returns errLowSpace if storing size more bytes would leave less than the configured free space.
+// An upload takes size bytes in the staging area, and as much in a local storage until it is complete:
+// twice size if they are on the same filesystem, unless the storage takes the staging file over.
+func (h *Handler) checkSpace(size int64) error {
+	if h.settings.MinFreeSpace == 0 {
+		return nil
+	}
+	needed := uint64(size)
+	if disk := storage.DiskOf(h.storage); disk != nil {
+		stagingFS, err := h.staging.Filesystem()
+		if err != nil {
+			return err
+		}
+		storageFS, err := disk.Filesystem()
+		if err != nil {
+			return err
+		}
+		_, moved := h.storage.(storage.Mover)
+		switch {
+		case storageFS != stagingFS:
+			if err = h.enoughSpace(disk, uint64(size)); err != nil {
+				return err
+			}
+		case !moved:
+			needed *= 2
+		}
+	}
+	return h.enoughSpace(h.staging, needed)
+}
+
+// enoughSpace returns errLowSpace if storing size more bytes on disk would leave less than the configured free space
+func (h *Handler) enoughSpace(disk storage.Disk, size uint64) error {
+	free, err := disk.FreeSpace()
+	if err != nil {
+		return err
+	}
+	if free < size || free-size < h.settings.MinFreeSpace {
+		return errLowSpace
+	}
+	return nil
+}
+
+// uploadRefused writes the response to an upload refused because of errTooLarge, errChecksumMismatch or errLowSpace,
+// and returns false for other errors
+func uploadRefused(res http.ResponseWriter, err error, max int64) bool {
+	switch err {
+	case errTooLarge:
+		// the rest of the body isn't read
+		res.Header().Set("Connection", "close")
+		res.Header().Set("X-Ezcp-Max-Size", strconv.FormatInt(max, 10))
+		res.WriteHeader(http.StatusRequestEntityTooLarge)
+	case errChecksumMismatch:
+		res.WriteHeader(400)
+	case errLowSpace:
+		res.Header().Set("Connection", "close")
+		res.Header().Set("Retry-After", "60")
+		res.WriteHeader(http.StatusInsufficientStorage)
+	default:
+		return false
+	}
+	res.Write([]byte(err.Error()))
+	return true
+}
@@ -0,0 +1,58 @@
+package routes
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// unsized hides the length of a body, so it is sent chunked
+type unsized struct {
+	io.Reader
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	x := newTransferTest(t)
+	token := x.token()
+	max := strconv.Itoa(testMaxFileSize - 1)
+
+	// a declared length is refused before reading the body
+	res := x.do(http.MethodPost, "/upload/"+token, nil, strings.Repeat("a", testMaxFileSize))
+	x.expect(res, http.StatusRequestEntityTooLarge, errTooLarge.Error())
+	if res.Header.Get("X-Ezcp-Max-Size") != max {
+		t.Errorf("X-Ezcp-Max-Size = %q, want %s", res.Header.Get("X-Ezcp-Max-Size"), max)
+	}
+
+	// a chunked body is stopped once it exceeds the limit, and the upload failed
+	res = x.do(http.MethodPost, "/upload/"+token, nil, unsized{strings.NewReader(strings.Repeat("a", testMaxFileSize))})
+	x.expect(res, http.StatusRequestEntityTooLarge, errTooLarge.Error())
+	if res.Header.Get("X-Ezcp-Max-Size") != max {
+		t.Errorf("X-Ezcp-Max-Size = %q mid-stream", res.Header.Get("X-Ezcp-Max-Size"))
+	}
+	if tok := x.status(token); tok.Status != "failed" || tok.Uploaded != nil {
+		t.Errorf("token = %+v after a too large upload", tok)
+	}
+
+	// the largest file the plan allows is accepted
+	x.expect(x.do(http.MethodPost, "/upload/"+token, nil, unsized{strings.NewReader(strings.Repeat("a", testMaxFileSize-1))}), 201, "")
+}
+
+func TestUploadLowSpace(t *testing.T) {
+	x := newTransferTest(t)
+	x.handler.settings.MinFreeSpace = math.MaxUint64 / 2
+	token := x.token()
+
+	res := x.do(http.MethodPost, "/upload/"+token, nil, "hello")
+	x.expect(res, http.StatusInsufficientStorage, errLowSpace.Error())
+	if res.Header.Get("Retry-After") == "" {
+		t.Error("no Retry-After")
+	}
+	x.expect(x.tusCreate(token, 5), http.StatusInsufficientStorage, errLowSpace.Error())
+
+	// once there is space again, the upload goes through
+	x.handler.settings.MinFreeSpace = 1
+	x.upload(token, "hello")
+}
@@ -0,0 +1,383 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ezcp.io/ezcp-server/db"
+	"ezcp.io/ezcp-server/payment"
+	"ezcp.io/ezcp-server/payment/bitgotest"
+	"ezcp.io/ezcp-server/plans"
+	"ezcp.io/ezcp-server/storage"
+	"ezcp.io/ezcp-server/tokens"
+	"github.com/gorilla/mux"
+)
+
+const (
+	testWallet        = "wallet"
+	testBitgoToken    = "bitgo-token"
+	testWebhookSecret = "webhook-secret"
+
+	// with 1 USD = 0.00002 BTC, basic costs 0.0001 BTC and pro 0.0004 BTC
+	basicSatoshis = 10000
+	proSatoshis   = 40000
+)
+
+var background = context.Background()
+
+// paymentTest drives the payment routes against a fake BitGo and a bbolt database
+type paymentTest struct {
+	t       *testing.T
+	bitgo   *bitgotest.Server
+	db      *db.Bolt
+	handler *Handler
+	router  *mux.Router
+}
+
+func newPaymentTest(t *testing.T) *paymentTest {
+	bitgo := bitgotest.NewServer(testWallet, testBitgoToken)
+	t.Cleanup(bitgo.Close)
+	database, err := db.NewBolt(filepath.Join(t.TempDir(), "ezcp.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(database.Close)
+	generator, _ := tokens.NewGenerator("hex")
+
+	catalog := &plans.Catalog{
+		Plans: []plans.Plan{
+			{Name: "free", Currency: "BTC", MaxFileSize: 1024, Retention: plans.Duration(time.Hour)},
+			{Name: "basic", Price: 5, Currency: "USD", Duration: plans.Duration(30 * 24 * time.Hour), MaxFileSize: 1024, Retention: plans.Duration(time.Hour)},
+			{Name: "pro", Price: 20, Currency: "USD", Duration: plans.Duration(365 * 24 * time.Hour), MaxFileSize: 1024, Retention: plans.Duration(time.Hour)},
+		},
+		Free:    "free",
+		Default: "basic",
+	}
+	h := &Handler{
+		db:         database,
+		storage:    storage.NewMemory(),
+		staging:    storage.NewStaging(t.TempDir()),
+		deliveries: newDeliveries(time.Minute),
+		relays:     newRelays(),
+		generator:  generator,
+		payment:    payment.NewBitgo(bitgo.URL, testBitgoToken, testWallet),
+		settings: Settings{
+			MinConfirmations: 2,
+			QuoteValidity:    time.Hour,
+			WebhookSecret:    testWebhookSecret,
+			Plans:            catalog,
+			Rates:            plans.FixedRates{"USD": 0.00002},
+		},
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/bitcoin", h.Bitcoin)
+	router.HandleFunc("/token/{tx}", h.GetTokenTx)
+	router.HandleFunc("/claim/{address}", h.Claim)
+	router.HandleFunc("/webhook/bitgo", h.Webhook)
+	return &paymentTest{t, bitgo, database, h, router}
+}
+
+func (p *paymentTest) do(method string, url string, header http.Header, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	res := httptest.NewRecorder()
+	p.router.ServeHTTP(res, req)
+	return res
+}
+
+// expect checks the status of a response, and that its body contains want
+func (p *paymentTest) expect(res *httptest.ResponseRecorder, status int, want string) string {
+	p.t.Helper()
+	if res.Code != status || !strings.Contains(res.Body.String(), want) {
+		p.t.Fatalf("got %d %q, want %d %q", res.Code, res.Body.String(), status, want)
+	}
+	return res.Body.String()
+}
+
+// pay scripts a transaction paying satoshis to address, with confirmations
+func (p *paymentTest) pay(txid string, address string, satoshis float64, confirmations int) {
+	p.payAt(txid, address, satoshis, confirmations, time.Now())
+}
+
+// payAt is pay with a transaction made at date
+func (p *paymentTest) payAt(txid string, address string, satoshis float64, confirmations int, date time.Time) {
+	p.bitgo.AddTransaction(db.Transaction{
+		ID:      txid,
+		Date:    date.UTC().Format("2006-01-02T15:04:05.000Z"),
+		Outputs: []db.Account{{Account: "sender", Value: -satoshis}, {Account: address, Value: satoshis, IsMine: true}},
+		Pending: confirmations == 0,
+
+		Confirmations: confirmations,
+	})
+}
+
+// address asks /bitcoin for an address, and returns it with its claim secret
+func (p *paymentTest) address(query string) (string, string) {
+	res := p.do(http.MethodPost, "/bitcoin"+query, nil, "")
+	address := p.expect(res, 200, "")
+	return address, res.Header().Get(claimSecretHeader)
+}
+
+func (p *paymentTest) webhook(txid string) *httptest.ResponseRecorder {
+	return p.do(http.MethodPost, "/webhook/bitgo?secret="+testWebhookSecret, nil, `{"type": "transaction", "hash": "`+txid+`"}`)
+}
+
+func (p *paymentTest) claim(address string, secret string) *httptest.ResponseRecorder {
+	return p.do(http.MethodGet, "/claim/"+address, http.Header{claimSecretHeader: {secret}}, "")
+}
+
+func (p *paymentTest) token(token string) *db.Token {
+	p.t.Helper()
+	tok, err := p.db.GetToken(background, token)
+	if err != nil || tok == nil {
+		p.t.Fatalf("GetToken(%s) = %v, %v", token, tok, err)
+	}
+	return tok
+}
+
+func TestBitcoin(t *testing.T) {
+	p := newPaymentTest(t)
+
+	address, secret := p.address("?claim=true")
+	if addresses := p.bitgo.Addresses(); len(addresses) != 1 || addresses[0] != address {
+		t.Errorf("address %s, BitGo created %v", address, addresses)
+	}
+	if secret == "" {
+		t.Error("no claim secret")
+	}
+	stored, _ := p.db.FindAddress(background, address)
+	if stored == nil || stored.Secret != secret || stored.Plan != "" {
+		t.Errorf("stored address = %+v", stored)
+	}
+
+	res := p.do(http.MethodPost, "/bitcoin?plan=pro", nil, "")
+	p.expect(res, 200, "")
+	if price := res.Header().Get(priceHeader); price != "0.00040000" {
+		t.Errorf("price = %s, want 0.00040000", price)
+	}
+
+	if expires, err := http.ParseTime(res.Header().Get(quoteExpiresHeader)); err != nil || expires.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("quote expires %v, %v", expires, err)
+	}
+
+	p.expect(p.do(http.MethodPost, "/bitcoin?plan=unknown", nil, ""), 400, "Unknown plan")
+	p.expect(p.do(http.MethodPost, "/bitcoin?plan=free", nil, ""), 400, "Unknown plan")
+	p.expect(p.do(http.MethodPost, "/bitcoin?token=missing", nil, ""), 404, "Permanent token not found")
+	p.expect(p.do(http.MethodGet, "/bitcoin", nil, ""), http.StatusMethodNotAllowed, "")
+}
+
+func TestGetTokenTxConfirmations(t *testing.T) {
+	p := newPaymentTest(t)
+	p.pay("tx1", "direct", basicSatoshis, 0)
+
+	// pending transactions aren't cached, they are checked again
+	p.expect(p.do(http.MethodPost, "/token/tx1", nil, ""), 202, "(0/2)")
+	p.bitgo.SetConfirmations("tx1", 1)
+	p.expect(p.do(http.MethodPost, "/token/tx1", nil, ""), 202, "(1/2)")
+	if tx, _ := p.db.LoadTransaction(background, "tx1"); tx != nil {
+		t.Error("a pending transaction was cached")
+	}
+
+	p.bitgo.SetConfirmations("tx1", 2)
+	token := p.expect(p.do(http.MethodPost, "/token/tx1", nil, ""), 201, "")
+	tok := p.token(token)
+	if !tok.Permanent || tok.Plan != "basic" || tok.Creator != "tx1" {
+		t.Errorf("token = %+v", tok)
+	}
+
+	// then it is cached
+	p.expect(p.do(http.MethodPost, "/token/tx1", nil, ""), 200, token)
+	p.expect(p.do(http.MethodGet, "/token/tx1", nil, ""), http.StatusMethodNotAllowed, "")
+}
+
+func TestGetTokenTxNotFound(t *testing.T) {
+	p := newPaymentTest(t)
+	p.expect(p.do(http.MethodPost, "/token/missing", nil, ""), 404, "Transaction not found")
+
+	// a transaction sent to someone else
+	p.bitgo.AddTransaction(db.Transaction{ID: "other", Outputs: []db.Account{{Account: "someone", Value: proSatoshis}}, Confirmations: 6})
+	p.expect(p.do(http.MethodPost, "/token/other", nil, ""), 401, "recepient")
+
+	// while BitGo doesn't find the wallet, transactions aren't reported missing
+	p.handler.payment = payment.NewBitgo(p.bitgo.URL, testBitgoToken, "renamed")
+	p.expect(p.do(http.MethodPost, "/token/missing", nil, ""), 500, "Can't tell if transaction missing exists")
+}
+
+func TestGetTokenTxPlans(t *testing.T) {
+	p := newPaymentTest(t)
+
+	// the most expensive plan the amount pays for
+	p.pay("pro", "direct", proSatoshis+1, 2)
+	tok := p.token(p.expect(p.do(http.MethodPost, "/token/pro", nil, ""), 201, ""))
+	if tok.Plan != "pro" {
+		t.Errorf("plan = %s, want pro", tok.Plan)
+	}
+	if expected := time.Now().Add(365 * 24 * time.Hour); tok.Expires == nil || tok.Expires.Sub(expected) > time.Minute || expected.Sub(*tok.Expires) > time.Minute {
+		t.Errorf("expires = %v, want a year from now", tok.Expires)
+	}
+
+	p.pay("basic", "direct", proSatoshis-1, 2)
+	if tok = p.token(p.expect(p.do(http.MethodPost, "/token/basic", nil, ""), 201, "")); tok.Plan != "basic" {
+		t.Errorf("plan = %s, want basic", tok.Plan)
+	}
+
+	p.pay("cheap", "direct", basicSatoshis-1, 2)
+	p.expect(p.do(http.MethodPost, "/token/cheap", nil, ""), 401, "amount wasn't enough")
+}
+
+func TestWebhookClaim(t *testing.T) {
+	p := newPaymentTest(t)
+	address, secret := p.address("?plan=basic&claim=true")
+
+	p.expect(p.claim(address, secret), 202, "Awaiting payment")
+	p.expect(p.claim(address, "wrong"), 401, "")
+	p.expect(p.claim("unknown", secret), 404, "Address not found")
+
+	p.pay("tx1", address, basicSatoshis, 1)
+	p.expect(p.do(http.MethodPost, "/webhook/bitgo?secret=wrong", nil, `{"hash": "tx1"}`), 401, "")
+	p.expect(p.do(http.MethodPost, "/webhook/bitgo?secret="+testWebhookSecret, nil, `{}`), 400, "Invalid notification")
+	p.expect(p.webhook("tx1"), 200, "")
+	p.expect(p.claim(address, secret), 202, db.ErrPending.Error())
+	p.expect(p.do(http.MethodPost, "/token/tx1", nil, ""), 202, "(1/2)")
+
+	// the claim settles the payment once confirmed, without waiting for another notification
+	p.bitgo.SetConfirmations("tx1", 2)
+	token := p.expect(p.claim(address, secret), 200, "")
+	if tok := p.token(token); tok.Plan != "basic" {
+		t.Errorf("plan = %s, want basic", tok.Plan)
+	}
+	p.expect(p.webhook("tx1"), 200, "")
+	p.expect(p.claim(address, secret), 200, token)
+
+	// the transaction ID is public, it doesn't give the token away
+	p.expect(p.do(http.MethodPost, "/token/tx1", nil, ""), 403, "/claim/"+address)
+}
+
+// TestLegacyAddress follows the CLI which pays to an address and gets its token with the transaction ID
+func TestLegacyAddress(t *testing.T) {
+	p := newPaymentTest(t)
+	address, secret := p.address("")
+	if secret != "" {
+		t.Errorf("claim secret %q without ?claim=true", secret)
+	}
+
+	p.pay("tx1", address, basicSatoshis, 1)
+	p.expect(p.do(http.MethodPost, "/token/tx1", nil, ""), 202, "(1/2)")
+	p.bitgo.SetConfirmations("tx1", 2)
+	token := p.expect(p.do(http.MethodPost, "/token/tx1", nil, ""), 201, "")
+	if tok := p.token(token); !tok.Permanent || tok.Plan != "basic" {
+		t.Errorf("token = %+v", tok)
+	}
+	p.expect(p.do(http.MethodPost, "/token/tx1", nil, ""), 200, token)
+	p.expect(p.claim(address, ""), 404, "no claim secret")
+
+	// nor does the webhook make the token claimed
+	address, _ = p.address("")
+	p.pay("tx2", address, basicSatoshis, 2)
+	p.expect(p.webhook("tx2"), 200, "")
+	p.expect(p.do(http.MethodPost, "/token/tx2", nil, ""), 200, "")
+}
+
+func TestWebhookChosenPlan(t *testing.T) {
+	p := newPaymentTest(t)
+	address, secret := p.address("?plan=pro&claim=true")
+
+	// enough for basic, but pro was chosen
+	p.pay("tx1", address, basicSatoshis, 2)
+	p.expect(p.webhook("tx1"), 200, "")
+	p.expect(p.claim(address, secret), 401, "amount wasn't enough")
+	p.expect(p.do(http.MethodPost, "/token/tx1", nil, ""), 401, "amount wasn't enough")
+	if tokens, _ := p.db.ListTokens(nil); len(tokens) != 0 {
+		t.Errorf("tokens minted: %v", tokens)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	p := newPaymentTest(t)
+	address, _ := p.address("")
+	p.pay("tx1", address, basicSatoshis, 2)
+
+	// BitGo retries notifications answered with an error
+	p.handler.payment = payment.NewBitgo(p.bitgo.URL, "revoked", testWallet)
+	p.expect(p.webhook("tx1"), 500, "")
+	p.handler.payment = payment.NewBitgo(p.bitgo.URL, testBitgoToken, testWallet)
+	p.expect(p.webhook("tx1"), 200, "")
+}
+
+func TestRenewal(t *testing.T) {
+	p := newPaymentTest(t)
+	expires := time.Now().Add(24 * time.Hour)
+	if err := p.db.CreateDurableToken(background, "renewed", "creator", "basic", expires); err != nil {
+		t.Fatal(err)
+	}
+
+	address, secret := p.address("?plan=pro&token=renewed")
+	p.pay("tx1", address, proSatoshis, 2)
+	p.expect(p.webhook("tx1"), 200, "")
+	p.expect(p.claim(address, secret), 200, "renewed")
+
+	tok := p.token("renewed")
+	want := expires.Add(365 * 24 * time.Hour)
+	if tok.Plan != "pro" || tok.Expires.Sub(want) > time.Second || want.Sub(*tok.Expires) > time.Second {
+		t.Errorf("renewed token = %+v, want pro until %v", tok, want)
+	}
+	tx, _ := p.db.LoadTransaction(background, "tx1")
+	if tx == nil || *tx.Token != "renewed" || tx.Extension != 365*24*time.Hour || tx.Address != address {
+		t.Errorf("cached renewal = %+v", tx)
+	}
+
+	// a transaction renews once
+	p.expect(p.webhook("tx1"), 200, "")
+	p.expect(p.do(http.MethodPost, "/token/tx1", nil, ""), 403, "/claim/"+address)
+	if again := p.token("renewed"); !again.Expires.Equal(*tok.Expires) {
+		t.Errorf("renewed twice, until %v", again.Expires)
+	}
+}
+
+func TestRenewalOfExpiredToken(t *testing.T) {
+	p := newPaymentTest(t)
+	p.db.CreateDurableToken(background, "expired", "creator", "basic", time.Now().Add(-24*time.Hour))
+
+	address, secret := p.address("?token=expired")
+	p.pay("tx1", address, basicSatoshis, 2)
+	p.expect(p.webhook("tx1"), 200, "")
+	p.expect(p.claim(address, secret), 200, "expired")
+
+	// extended from now
+	want := time.Now().Add(30 * 24 * time.Hour)
+	if tok := p.token("expired"); tok.Expires.Sub(want) > time.Minute || want.Sub(*tok.Expires) > time.Minute {
+		t.Errorf("expires = %v, want %v", tok.Expires, want)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	p := newPaymentTest(t)
+	chosen, chosenSecret := p.address("?plan=basic&claim=true")
+	unchosen, unchosenSecret := p.address("?claim=true")
+	late, lateSecret := p.address("?plan=basic&claim=true")
+
+	// BTC lost a fifth since the quotes, payments made while they are valid still pay for the quoted plans
+	p.handler.settings.Rates = plans.FixedRates{"USD": 0.000025}
+	p.pay("tx1", chosen, basicSatoshis, 2)
+	p.expect(p.webhook("tx1"), 200, "")
+	p.expect(p.claim(chosen, chosenSecret), 200, "")
+
+	p.pay("tx2", unchosen, proSatoshis, 2)
+	p.expect(p.webhook("tx2"), 200, "")
+	if tok := p.token(p.expect(p.claim(unchosen, unchosenSecret), 200, "")); tok.Plan != "pro" {
+		t.Errorf("plan = %s, want the quoted pro", tok.Plan)
+	}
+
+	// later payments are priced again
+	p.payAt("tx3", late, basicSatoshis, 2, time.Now().Add(2*time.Hour))
+	p.expect(p.webhook("tx3"), 200, "")
+	p.expect(p.claim(late, lateSecret), 401, "wasn't enough")
+}
@@ -0,0 +1,191 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"ezcp.io/ezcp-server/db"
+	"ezcp.io/ezcp-server/plans"
+)
+
+// plan returns the plan of a token
+func (h *Handler) plan(tok *db.Token) *plans.Plan {
+	return h.settings.Plans.ForToken(tok.Permanent, tok.Plan)
+}
+
+// invalidPayment is the error of a transaction which doesn't pay for a plan,
+// as opposed to a failure to check it, which is worth retrying
+type invalidPayment struct {
+	error
+}
+
+// isInvalidPayment returns whether err is the error of a transaction which doesn't pay for a plan
+func isInvalidPayment(err error) bool {
+	_, ok := err.(invalidPayment)
+	return ok
+}
+
+// quote returns the prices in BTC a transaction paying to address is checked against: the quote of the address
+// if the transaction was made while it was valid, otherwise the prices at the current rates.
+// plan restricts a new quote to one plan, address may be nil.
+func (h *Handler) quote(tx *db.Transaction, address *db.Address, plan *plans.Plan) (plans.Quote, error) {
+	if address != nil && address.Quote != nil && tx.GetDate().Before(address.Quoted.Add(h.settings.QuoteValidity)) {
+		return address.Quote, nil
+	}
+	return h.settings.Plans.Quote(h.settings.Rates, plan)
+}
+
+// transactionPlan returns the plan a transaction pays for, and the price it must have paid in BTC.
+// Transactions which already minted a token keep their plan, and aren't priced again.
+// Otherwise it is the plan chosen with the payment address, or the most expensive plan the amount pays for,
+// priced by the quote of the address while it is valid. address is nil if it didn't pay to one from /bitcoin.
+func (h *Handler) transactionPlan(ctx context.Context, tx *db.Transaction, address *db.Address) (*plans.Plan, float64, error) {
+	if tx.Token != nil {
+		return h.settings.Plans.ForToken(true, tx.Plan), 0, nil
+	}
+	if address != nil && address.Plan != "" {
+		plan := h.settings.Plans.Get(address.Plan)
+		if plan == nil {
+			return nil, 0, invalidPayment{errors.New("Unknown plan " + address.Plan)}
+		}
+		quote, err := h.quote(tx, address, plan)
+		if err != nil {
+			return nil, 0, err
+		}
+		price, ok := quote[plan.Name]
+		if !ok {
+			// the plan wasn't paid when quoted
+			price, err = plans.PriceBtc(plan, h.settings.Rates)
+		}
+		return plan, price, err
+	}
+	acc := tx.GetOurAccountEntry()
+	if acc == nil {
+		return nil, 0, invalidPayment{errors.New("EZCP wasn't the recepient of the transaction")}
+	}
+	quote, err := h.quote(tx, address, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	plan, price, err := h.settings.Plans.ForAmount(acc.ValueBTC(), quote)
+	if err == plans.ErrInsufficientAmount {
+		err = invalidPayment{err}
+	}
+	return plan, price, err
+}
+
+// checkPayment checks a transaction pays for its plan, see db.Transaction.Check.
+// Once a token is issued, the subscription lasts until the token expires.
+// The errors of transactions which don't pay are invalidPayment, except db.ErrPending.
+func (h *Handler) checkPayment(ctx context.Context, tx *db.Transaction, address *db.Address, minConfirmations int) (*plans.Plan, error) {
+	plan, price, err := h.transactionPlan(ctx, tx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	expires := tx.GetDate().Add(plan.Duration.Std())
+	if tx.Token != nil && !tx.Revoked {
+		tok, err := h.db.GetToken(ctx, *tx.Token)
+		if err != nil {
+			return nil, err
+		}
+		if tok == nil {
+			return nil, invalidPayment{errors.New("Token not found")}
+		}
+		if expires, err = h.expiry(ctx, tok); err != nil {
+			return nil, err
+		}
+	}
+	err = tx.Check(price, expires, minConfirmations)
+	if err != nil && err != db.ErrPending {
+		err = invalidPayment{err}
+	}
+	return plan, err
+}
+
+// expiry returns when a permanent token expires. Tokens created before expiries were stored
+// expire one plan duration after the transaction which created them, or after their creation
+// if that transaction has expired. It is stored on first use.
+func (h *Handler) expiry(ctx context.Context, tok *db.Token) (time.Time, error) {
+	if tok.Expires != nil {
+		return *tok.Expires, nil
+	}
+	tx, err := h.db.LoadTransaction(ctx, tok.Creator)
+	if err != nil {
+		return time.Time{}, err
+	}
+	start := tok.Created
+	if tx != nil {
+		start = tx.GetDate()
+	}
+	expires := start.Add(h.plan(tok).Duration.Std())
+	if err = h.db.TokenExpiryComputed(ctx, tok.Token, expires); err != nil {
+		return time.Time{}, err
+	}
+	tok.Expires = &expires
+	return expires, nil
+}
+
+// checkExpiry writes the error response and returns false if a permanent token has expired
+func (h *Handler) checkExpiry(ctx context.Context, res http.ResponseWriter, tok *db.Token) bool {
+	if !tok.Permanent {
+		return true
+	}
+	if _, err := h.expiry(ctx, tok); err != nil {
+		h.internalError(res, err)
+		return false
+	}
+	if tok.IsExpired() {
+		res.WriteHeader(http.StatusPaymentRequired)
+		res.Write([]byte("Subscription has expired, renew it with POST /bitcoin?token=" + tok.Token))
+		return false
+	}
+	return true
+}
+
+// renewToken extends a permanent token by the duration of the plan a checked transaction paid for,
+// and caches the transaction. If the transaction was cached concurrently, the cached one is returned.
+// The transaction is only counted once the token is extended.
+func (h *Handler) renewToken(ctx context.Context, tx *db.Transaction, plan *plans.Plan, token string) (*db.Transaction, error) {
+	tok, err := h.db.GetToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if tok == nil {
+		return nil, invalidPayment{errors.New("Token not found")}
+	}
+	if _, err = h.expiry(ctx, tok); err != nil {
+		return nil, err
+	}
+
+	// kept until it couldn't pay for a subscription anyway, so it's never counted twice
+	expiresAt := tx.GetDate().Add(plan.Duration.Std() + db.ExpiredRetention)
+	renewal := *tx
+	renewal.Token = &token
+	renewal.Plan = plan.Name
+	renewal.Extension = plan.Duration.Std()
+	renewal.ExpiresAt = &expiresAt
+
+	// cache first, so a transaction is never counted twice
+	err = h.db.StoreTransaction(ctx, &renewal)
+	if db.IsDuplicate(err) {
+		return h.db.LoadTransaction(ctx, tx.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = h.db.ExtendToken(ctx, token, plan.Name, renewal.Extension); err != nil {
+		// forgotten, so the transaction renews the token when it's checked again
+		forget, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if removeErr := h.db.RemoveTransaction(forget, tx.ID); removeErr != nil {
+			log.Print("Can't forget transaction ", tx.ID, " of a failed renewal: ", removeErr)
+		}
+		return nil, err
+	}
+	return &renewal, nil
+}
@@ -0,0 +1,230 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"ezcp.io/ezcp-server/db"
+)
+
+// relayWindow is how far an upload may get ahead of its live download
+const relayWindow = 4 * db.MiB
+
+var (
+	errRelayBusy    = errors.New("Token is already being downloaded")
+	errUploadFailed = errors.New("Upload aborted")
+)
+
+// relays tracks the uploads in progress, so they can be downloaded while they're uploaded.
+// A resumable upload is tracked while one of its PATCHes is in progress, or it is downloaded live.
+type relays struct {
+	mutex  sync.Mutex
+	active map[string]*relay
+}
+
+func newRelays() *relays {
+	return &relays{active: make(map[string]*relay)}
+}
+
+// start registers an upload in progress for token, a previous one failed
+func (r *relays) start(token string) *relay {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if previous := r.active[token]; previous != nil {
+		previous.finish(errUploadFailed)
+	}
+	each := newRelay(0)
+	r.active[token] = each
+	return each
+}
+
+// resume returns the resumable upload in progress for token, or registers it with the offset bytes
+// of its staging file. The caller is a PATCH or a live download, it must call pause once done.
+func (r *relays) resume(token string, offset int64, patch bool) *relay {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	each := r.active[token]
+	if each == nil {
+		each = newRelay(offset)
+		each.paused = true
+		r.active[token] = each
+	}
+	if patch {
+		each.mutex.Lock()
+		each.paused = false
+		each.mutex.Unlock()
+	}
+	return each
+}
+
+// pause tells the PATCH or the live download of an upload is over. A resumable upload is unregistered
+// when neither a PATCH nor a live download is in progress.
+func (r *relays) pause(token string, each *relay, patch bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	each.mutex.Lock()
+	defer each.mutex.Unlock()
+	if patch {
+		each.paused = true
+	}
+	if each.paused && !each.reading && r.active[token] == each {
+		delete(r.active, token)
+	}
+}
+
+// get returns the upload in progress for token, or nil
+func (r *relays) get(token string) *relay {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.active[token]
+}
+
+// stop unregisters an upload in progress, and tells its live download how it ended
+func (r *relays) stop(token string, each *relay, err error) {
+	r.mutex.Lock()
+	if r.active[token] == each {
+		delete(r.active, token)
+	}
+	r.mutex.Unlock()
+
+	each.mutex.Lock()
+	defer each.mutex.Unlock()
+	each.finish(err)
+}
+
+// fail ends the upload in progress for token as failed, if any
+func (r *relays) fail(token string) {
+	if each := r.get(token); each != nil {
+		r.stop(token, each, errUploadFailed)
+	}
+}
+
+// newRelay returns the relay of an upload whose staging file has written bytes already
+func newRelay(written int64) *relay {
+	each := &relay{written: written}
+	each.cond = sync.NewCond(&each.mutex)
+	return each
+}
+
+// relay synchronizes an upload with at most one live download,
+// the bytes go through the staging file
+type relay struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	written  int64 // bytes written to the staging file
+	read     int64 // bytes sent to the live download
+	reading  bool  // a live download is attached
+	paused   bool  // a resumable upload between PATCHes
+	finished bool
+	err      error
+}
+
+// finish tells the live download how the upload ended, the caller holds the mutex
+func (r *relay) finish(err error) {
+	r.finished = true
+	r.err = err
+	r.cond.Broadcast()
+}
+
+// advance makes n more bytes written to the staging file available to the live download
+func (r *relay) advance(n int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.written += n
+	r.cond.Broadcast()
+}
+
+// writer wraps the upload's destination, so it notifies the live download
+// and waits for it when it's more than relayWindow bytes behind
+func (r *relay) writer(w io.Writer) io.Writer {
+	return &relayWriter{r, w}
+}
+
+type relayWriter struct {
+	relay *relay
+	w     io.Writer
+}
+
+func (rw *relayWriter) Write(b []byte) (int, error) {
+	r := rw.relay
+	r.mutex.Lock()
+	for r.reading && r.written-r.read > relayWindow {
+		r.cond.Wait()
+	}
+	r.mutex.Unlock()
+
+	n, err := rw.w.Write(b)
+	r.advance(int64(n))
+	return n, err
+}
+
+// follow copies the staging file src to dst as it is written, until the upload ends or ctx is done.
+// It returns errUploadFailed if the upload didn't complete.
+func (r *relay) follow(ctx context.Context, dst io.Writer, src io.Reader) error {
+	r.mutex.Lock()
+	if r.reading {
+		r.mutex.Unlock()
+		return errRelayBusy
+	}
+	r.reading = true
+	r.mutex.Unlock()
+
+	// wakes the wait for more bytes when the download is over
+	stop := context.AfterFunc(ctx, func() {
+		r.mutex.Lock()
+		r.cond.Broadcast()
+		r.mutex.Unlock()
+	})
+	defer func() {
+		stop()
+		r.mutex.Lock()
+		r.reading = false
+		r.cond.Broadcast()
+		r.mutex.Unlock()
+	}()
+
+	flusher, _ := dst.(http.Flusher)
+	buffer := make([]byte, 32*1024)
+	for {
+		r.mutex.Lock()
+		for r.read == r.written && !r.finished && ctx.Err() == nil {
+			r.cond.Wait()
+		}
+		available := r.written - r.read
+		finished, err := r.finished, r.err
+		r.mutex.Unlock()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if available == 0 && finished {
+			if err != nil {
+				return errUploadFailed
+			}
+			return nil
+		}
+
+		if available > int64(len(buffer)) {
+			available = int64(len(buffer))
+		}
+		n, err := io.ReadFull(src, buffer[:available])
+		if err != nil {
+			return err
+		}
+		if _, err = dst.Write(buffer[:n]); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		r.mutex.Lock()
+		r.read += int64(n)
+		r.cond.Broadcast()
+		r.mutex.Unlock()
+	}
+}
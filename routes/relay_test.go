@@ -0,0 +1,140 @@
+package routes
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// liveUpload is a POST upload whose body is written by the test
+type liveUpload struct {
+	body *io.PipeWriter
+	done chan *http.Response
+}
+
+func (x *transferTest) startUpload(token string) *liveUpload {
+	x.t.Helper()
+	reader, writer := io.Pipe()
+	upload := &liveUpload{writer, make(chan *http.Response, 1)}
+	req, err := http.NewRequest(http.MethodPost, x.server.URL+"/upload/"+token, reader)
+	if err != nil {
+		x.t.Fatal(err)
+	}
+	// a failed test doesn't leave the server waiting for the body
+	x.t.Cleanup(func() { writer.CloseWithError(errors.New("test over")) })
+	go func() {
+		res, err := x.server.Client().Do(req)
+		if err != nil {
+			res = &http.Response{StatusCode: 0, Body: ioutil.NopCloser(strings.NewReader(err.Error()))}
+		}
+		upload.done <- res
+	}()
+	return upload
+}
+
+// readLive reads n bytes of a live download
+func readLive(t *testing.T, res *http.Response, n int) string {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := io.ReadFull(res.Body, data); err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestLiveDownload(t *testing.T) {
+	x := newTransferTest(t)
+	token := x.token()
+	upload := x.startUpload(token)
+	upload.body.Write([]byte("hello, "))
+	x.waitRelay(token, 7)
+
+	download := x.do(http.MethodGet, "/download/"+token, nil, nil)
+	if _, declared := download.Trailer["X-Checksum-Sha256"]; download.StatusCode != 200 || !declared {
+		t.Fatalf("live download = %d, trailers %v", download.StatusCode, download.Trailer)
+	}
+	if read := readLive(t, download, 7); read != "hello, " {
+		t.Errorf("read %q while uploading", read)
+	}
+	upload.body.Write([]byte("world"))
+	upload.body.Close()
+	x.expect(<-upload.done, 201, "")
+
+	rest := x.expect(download, 200, "")
+	sum := sha256.Sum256([]byte("hello, world"))
+	if rest != "world" || download.Trailer.Get("X-Checksum-SHA256") != hex.EncodeToString(sum[:]) {
+		t.Errorf("read %q then trailers %v", rest, download.Trailer)
+	}
+	if download.Trailer.Get("Digest") == "" {
+		t.Error("no Digest trailer")
+	}
+
+	// the live download was the only one the free plan allows
+	x.expect(x.do(http.MethodGet, "/download/"+token, nil, nil), 404, "")
+}
+
+func TestLiveDownloadAborted(t *testing.T) {
+	x := newTransferTest(t)
+	token := x.token()
+	upload := x.startUpload(token)
+	upload.body.Write([]byte("partial"))
+	x.waitRelay(token, 7)
+
+	download := x.do(http.MethodGet, "/download/"+token, nil, nil)
+	readLive(t, download, 7)
+	upload.body.CloseWithError(errors.New("client gone"))
+	(<-upload.done).Body.Close()
+
+	// the reader can't mistake the partial file for a complete one
+	if rest, err := ioutil.ReadAll(download.Body); err == nil {
+		t.Errorf("the aborted download ended with %q and no error", rest)
+	}
+	download.Body.Close()
+}
+
+func TestLiveDownloadBusy(t *testing.T) {
+	x := newTransferTest(t)
+	token := x.token()
+	upload := x.startUpload(token)
+	upload.body.Write([]byte("data"))
+	x.waitRelay(token, 4)
+
+	download := x.do(http.MethodGet, "/download/"+token, nil, nil)
+	readLive(t, download, 4)
+	x.expect(x.do(http.MethodGet, "/download/"+token, nil, nil), 409, errRelayBusy.Error())
+
+	upload.body.Close()
+	x.expect(<-upload.done, 201, "")
+	x.expect(download, 200, "")
+}
+
+func TestLiveDownloadResumable(t *testing.T) {
+	x := newTransferTest(t)
+	token := x.token()
+	x.expect(x.tusCreate(token, 12), 201, "")
+
+	// between PATCHes, the download gets what was uploaded so far and waits for the rest
+	x.expect(x.tusPatch(token, 0, "hello, ", ""), http.StatusNoContent, "")
+	download := x.do(http.MethodGet, "/download/"+token, nil, nil)
+	if download.StatusCode != 200 {
+		t.Fatalf("live download = %d", download.StatusCode)
+	}
+	if read := readLive(t, download, 7); read != "hello, " {
+		t.Errorf("read %q between PATCHes", read)
+	}
+	x.expect(x.tusPatch(token, 7, "world", ""), http.StatusNoContent, "")
+
+	rest := x.expect(download, 200, "")
+	sum := sha256.Sum256([]byte("hello, world"))
+	if rest != "world" || download.Trailer.Get("X-Checksum-SHA256") != hex.EncodeToString(sum[:]) {
+		t.Errorf("read %q then trailers %v", rest, download.Trailer)
+	}
+	if x.handler.relays.get(token) != nil {
+		t.Error("the completed upload is still relayed")
+	}
+}
@@ -0,0 +1,333 @@
+package routes
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"ezcp.io/ezcp-server/db"
+	"ezcp.io/ezcp-server/storage"
+	"github.com/gorilla/mux"
+)
+
+// Resumable uploads, see https://tus.io/protocols/resumable-upload.html
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,termination,checksum"
+	tusContentType = "application/offset+octet-stream"
+
+	// tusChecksumAlgorithms are the algorithms of the checksum extension's Upload-Checksum
+	tusChecksumAlgorithms = "sha1,sha256,md5"
+
+	// statusChecksumMismatch is the tus status of a PATCH which doesn't match its Upload-Checksum
+	statusChecksumMismatch = 460
+)
+
+// tusOptions describes the server's tus support
+func (h *Handler) tusOptions(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Tus-Resumable", tusVersion)
+	res.Header().Set("Tus-Version", tusVersion)
+	res.Header().Set("Tus-Extension", tusExtensions)
+	res.Header().Set("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// tusCreate starts a resumable upload of Upload-Length bytes
+func (h *Handler) tusCreate(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	token := mux.Vars(req)["token"]
+	tok := h.tusToken(res, req)
+	if tok == nil {
+		return
+	}
+
+	length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		res.WriteHeader(400)
+		res.Write([]byte("Invalid Upload-Length"))
+		return
+	}
+	max := h.plan(tok).MaxSize()
+	if length > max {
+		uploadRefused(res, errTooLarge, max)
+		return
+	}
+	if err = h.checkSpace(length); err != nil {
+		if !uploadRefused(res, err, max) {
+			h.internalError(res, err)
+		}
+		return
+	}
+
+	partial, err := h.staging.CreateWriter(token)
+	if err == storage.ErrBusy {
+		res.WriteHeader(409)
+		res.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		h.internalError(res, err)
+		return
+	}
+	h.relays.fail(token) // the previous upload is discarded
+	err = h.db.TokenUploadCreated(ctx, token, length)
+	if err != nil {
+		partial.Close()
+		h.internalError(res, err)
+		return
+	}
+
+	// all requests for this upload must reach the same server
+	location := "/upload/" + token
+	if req.Host != h.settings.DevHost {
+		location = "https://" + h.apiHost(token) + location
+	}
+	if length == 0 {
+		err = h.complete(ctx, token, 0, nil)
+		if err != nil {
+			partial.Close()
+			h.internalError(res, err)
+			return
+		}
+		partial.Discard()
+	} else {
+		partial.Close()
+	}
+	res.Header().Set("Location", location)
+	res.Header().Set("Upload-Offset", "0")
+	res.WriteHeader(201)
+}
+
+// tusHead returns the current offset of a resumable upload
+func (h *Handler) tusHead(res http.ResponseWriter, req *http.Request) {
+	token := mux.Vars(req)["token"]
+	tok := h.tusToken(res, req)
+	if tok == nil {
+		return
+	}
+
+	offset, err := h.staging.Offset(token)
+	length := tok.UploadLength
+	if err == storage.ErrNotFound && tok.Uploaded != nil {
+		offset, length = tok.Length, tok.Length
+	} else if err == storage.ErrNotFound {
+		res.WriteHeader(404)
+		return
+	} else if err != nil {
+		h.internalError(res, err)
+		return
+	}
+
+	res.Header().Set("Cache-Control", "no-store")
+	res.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	res.Header().Set("Upload-Length", strconv.FormatInt(length, 10))
+	res.WriteHeader(200)
+}
+
+// tusPatch appends the request body to a resumable upload
+// The token is marked uploaded once the declared length has been received.
+// A body which doesn't match its Upload-Checksum is discarded, so the client sends it again.
+// The upload can be downloaded live, a body with an Upload-Checksum once verified.
+func (h *Handler) tusPatch(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	token := mux.Vars(req)["token"]
+	tok := h.tusToken(res, req)
+	if tok == nil {
+		return
+	}
+
+	if req.Header.Get("Content-Type") != tusContentType {
+		res.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		res.WriteHeader(400)
+		res.Write([]byte("Invalid Upload-Offset"))
+		return
+	}
+	digest, expected, err := tusChecksum(req.Header)
+	if err != nil {
+		res.WriteHeader(400)
+		res.Write([]byte(err.Error()))
+		return
+	}
+	remaining := tok.UploadLength - offset
+	if req.ContentLength > remaining {
+		res.WriteHeader(http.StatusRequestEntityTooLarge)
+		res.Write([]byte("Upload exceeds Upload-Length"))
+		return
+	}
+
+	// the partial upload stays locked until complete, so another PATCH is refused
+	partial, err := h.staging.Writer(token, offset)
+	switch err {
+	case nil:
+	case storage.ErrNotFound:
+		res.WriteHeader(404)
+		return
+	case storage.ErrOffsetMismatch, storage.ErrBusy:
+		res.WriteHeader(409)
+		res.Write([]byte(err.Error()))
+		return
+	default:
+		h.internalError(res, err)
+		return
+	}
+
+	relay := h.relays.resume(token, offset, true)
+	defer h.relays.pause(token, relay, true)
+	destination := relay.writer(partial)
+	body := io.Reader(newSizeLimiter(req.Body, remaining))
+	if digest != nil {
+		destination = partial
+		body = io.TeeReader(body, digest)
+	}
+	written, err := io.Copy(destination, body)
+	if digest != nil && (err != nil || !bytes.Equal(digest.Sum(nil), expected)) {
+		// what was received can't be verified, or is corrupted
+		if err == nil {
+			err = errChecksumMismatch
+		}
+		if truncateErr := partial.Truncate(offset); truncateErr != nil {
+			partial.Close()
+			h.internalError(res, truncateErr)
+			return
+		}
+		written = 0
+	} else if digest != nil {
+		relay.advance(written)
+	}
+	newOffset := offset + written
+	switch err {
+	case nil:
+	case errChecksumMismatch:
+		partial.Close()
+		res.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		res.WriteHeader(statusChecksumMismatch)
+		res.Write([]byte(err.Error()))
+		return
+	case errTooLarge:
+		// what fits was kept, a PATCH at the new offset completes the upload
+		partial.Close()
+		res.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+		uploadRefused(res, err, tok.UploadLength)
+		return
+	default:
+		// the client can resume from the offset we stored
+		partial.Close()
+		log.Print("Upload interrupted ", token, " at ", newOffset, ": ", err)
+		res.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+		res.WriteHeader(400)
+		return
+	}
+
+	if newOffset < tok.UploadLength {
+		partial.Close()
+	} else if err = h.complete(ctx, token, newOffset, nil); err != nil {
+		partial.Close()
+		h.internalError(res, err)
+		return
+	} else {
+		h.relays.stop(token, relay, nil)
+		partial.Discard()
+	}
+
+	res.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// tusDelete terminates a resumable upload
+func (h *Handler) tusDelete(res http.ResponseWriter, req *http.Request) {
+	token := mux.Vars(req)["token"]
+	if h.tusToken(res, req) == nil {
+		return
+	}
+
+	err := h.staging.Remove(token)
+	if err == storage.ErrNotFound {
+		res.WriteHeader(404)
+		return
+	}
+	if err == storage.ErrBusy {
+		res.WriteHeader(409)
+		res.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		h.internalError(res, err)
+		return
+	}
+	h.relays.fail(token)
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// tusToken checks the protocol version and returns the token being uploaded,
+// or writes the error response and returns nil
+func (h *Handler) tusToken(res http.ResponseWriter, req *http.Request) *db.Token {
+	ctx := req.Context()
+	res.Header().Set("Tus-Resumable", tusVersion)
+	if req.Header.Get("Tus-Resumable") != tusVersion {
+		res.Header().Set("Tus-Version", tusVersion)
+		res.WriteHeader(http.StatusPreconditionFailed)
+		return nil
+	}
+
+	tok, err := h.db.GetToken(ctx, mux.Vars(req)["token"])
+	if err != nil {
+		h.internalError(res, err)
+		return nil
+	}
+	if tok == nil {
+		res.WriteHeader(404)
+		res.Write([]byte("Token not found"))
+		return nil
+	}
+	if tok.Uploaded != nil && !tok.Permanent && req.Method != http.MethodHead {
+		res.WriteHeader(404)
+		res.Write([]byte("Token already uploaded"))
+		return nil
+	}
+	if req.Method != http.MethodHead && !h.checkExpiry(ctx, res, tok) {
+		return nil
+	}
+	return tok
+}
+
+// tusChecksum parses the Upload-Checksum of a PATCH, "algorithm base64-digest" of its body.
+// It returns the hash computing the digest and the expected one, or nil if there's no Upload-Checksum.
+func tusChecksum(header http.Header) (hash.Hash, []byte, error) {
+	value := strings.TrimSpace(header.Get("Upload-Checksum"))
+	if value == "" {
+		return nil, nil, nil
+	}
+	parts := strings.SplitN(value, " ", 2)
+	if len(parts) != 2 {
+		return nil, nil, errors.New("Invalid Upload-Checksum")
+	}
+	var digest hash.Hash
+	switch strings.ToLower(parts[0]) {
+	case "sha1":
+		digest = sha1.New()
+	case "sha256":
+		digest = sha256.New()
+	case "md5":
+		digest = md5.New()
+	default:
+		return nil, nil, errors.New("Unsupported checksum algorithm " + parts[0])
+	}
+	expected, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+	if err != nil || len(expected) != digest.Size() {
+		return nil, nil, errors.New("Invalid Upload-Checksum")
+	}
+	return digest, expected, nil
+}
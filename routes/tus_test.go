@@ -0,0 +1,137 @@
+package routes
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// tusCreate starts a resumable upload of length bytes to token
+func (x *transferTest) tusCreate(token string, length int) *http.Response {
+	x.t.Helper()
+	return x.do(http.MethodPost, "/upload/"+token, http.Header{
+		"Tus-Resumable": {tusVersion},
+		"Upload-Length": {strconv.Itoa(length)},
+	}, nil)
+}
+
+// tusPatch sends data at offset, with the Upload-Checksum checksum if not empty
+func (x *transferTest) tusPatch(token string, offset int, data string, checksum string) *http.Response {
+	x.t.Helper()
+	header := http.Header{
+		"Tus-Resumable": {tusVersion},
+		"Content-Type":  {tusContentType},
+		"Upload-Offset": {strconv.Itoa(offset)},
+	}
+	if checksum != "" {
+		header.Set("Upload-Checksum", checksum)
+	}
+	return x.do(http.MethodPatch, "/upload/"+token, header, data)
+}
+
+// tusOffset returns the Upload-Offset of a HEAD request, and expects a 200
+func (x *transferTest) tusOffset(token string) string {
+	x.t.Helper()
+	res := x.do(http.MethodHead, "/upload/"+token, http.Header{"Tus-Resumable": {tusVersion}}, nil)
+	x.expect(res, 200, "")
+	return res.Header.Get("Upload-Offset")
+}
+
+func sha1Checksum(data string) string {
+	sum := sha1.Sum([]byte(data))
+	return "sha1 " + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestTusUpload(t *testing.T) {
+	x := newTransferTest(t)
+	token := x.token()
+	create := x.tusCreate(token, 12)
+	x.expect(create, 201, "")
+	if create.Header.Get("Location") != "/upload/"+token || create.Header.Get("Upload-Offset") != "0" {
+		t.Errorf("created at %q, offset %q", create.Header.Get("Location"), create.Header.Get("Upload-Offset"))
+	}
+	if offset := x.tusOffset(token); offset != "0" {
+		t.Errorf("offset = %s after creation", offset)
+	}
+
+	x.expect(x.tusPatch(token, 0, "hello, ", ""), http.StatusNoContent, "")
+	if offset := x.tusOffset(token); offset != "7" {
+		t.Errorf("offset = %s, want 7", offset)
+	}
+
+	// a PATCH which doesn't start at the offset is refused, the client asks for it again
+	x.expect(x.tusPatch(token, 3, "lo, world", ""), 409, "")
+	x.expect(x.tusPatch(token, 12, "", ""), 409, "")
+
+	res := x.tusPatch(token, 7, "world", sha1Checksum("world"))
+	x.expect(res, http.StatusNoContent, "")
+	if res.Header.Get("Upload-Offset") != "12" {
+		t.Errorf("offset = %s once complete", res.Header.Get("Upload-Offset"))
+	}
+	if offset := x.tusOffset(token); offset != "12" {
+		t.Errorf("offset = %s once uploaded, want 12", offset)
+	}
+	x.expect(x.do(http.MethodGet, "/download/"+token, nil, nil), 200, "hello, world")
+}
+
+func TestTusChecksumMismatch(t *testing.T) {
+	x := newTransferTest(t)
+	token := x.token()
+	x.expect(x.tusCreate(token, 12), 201, "")
+	x.expect(x.tusPatch(token, 0, "hello, ", sha1Checksum("hello, ")), http.StatusNoContent, "")
+
+	// the corrupted body is discarded, and the offset stays where it was
+	res := x.tusPatch(token, 7, "w0rld", sha1Checksum("world"))
+	x.expect(res, statusChecksumMismatch, errChecksumMismatch.Error())
+	if res.Header.Get("Upload-Offset") != "7" {
+		t.Errorf("offset = %s after a mismatch", res.Header.Get("Upload-Offset"))
+	}
+	if offset := x.tusOffset(token); offset != "7" {
+		t.Errorf("offset = %s after a mismatch, want 7", offset)
+	}
+	x.expect(x.tusPatch(token, 7, "world", "sha1 invalid"), 400, "Invalid Upload-Checksum")
+	x.expect(x.tusPatch(token, 7, "world", "crc32 AAAAAA=="), 400, "Unsupported checksum algorithm")
+
+	x.expect(x.tusPatch(token, 7, "world", sha1Checksum("world")), http.StatusNoContent, "")
+	x.expect(x.do(http.MethodGet, "/download/"+token, nil, nil), 200, "hello, world")
+}
+
+func TestTusDelete(t *testing.T) {
+	x := newTransferTest(t)
+	token := x.token()
+	x.expect(x.tusCreate(token, 12), 201, "")
+	x.expect(x.tusPatch(token, 0, "hello, ", ""), http.StatusNoContent, "")
+
+	terminate := http.Header{"Tus-Resumable": {tusVersion}}
+	x.expect(x.do(http.MethodDelete, "/upload/"+token, terminate, nil), http.StatusNoContent, "")
+	x.expect(x.do(http.MethodHead, "/upload/"+token, terminate, nil), 404, "")
+	x.expect(x.tusPatch(token, 7, "world", ""), 404, "")
+	x.expect(x.do(http.MethodDelete, "/upload/"+token, terminate, nil), 404, "")
+
+	// the token can be uploaded again
+	x.expect(x.tusCreate(token, 5), 201, "")
+	x.expect(x.tusPatch(token, 0, "again", ""), http.StatusNoContent, "")
+	x.expect(x.do(http.MethodGet, "/download/"+token, nil, nil), 200, "again")
+}
+
+func TestTusProtocol(t *testing.T) {
+	x := newTransferTest(t)
+	token := x.token()
+
+	options := x.do(http.MethodOptions, "/upload/"+token, nil, nil)
+	x.expect(options, http.StatusNoContent, "")
+	if options.Header.Get("Tus-Extension") != tusExtensions || options.Header.Get("Tus-Checksum-Algorithm") != tusChecksumAlgorithms {
+		t.Errorf("OPTIONS = %v", options.Header)
+	}
+	x.expect(x.do(http.MethodPost, "/upload/"+token, http.Header{"Tus-Resumable": {"0.2.2"}, "Upload-Length": {"5"}}, nil),
+		http.StatusPreconditionFailed, "")
+	x.expect(x.tusCreate(token, testMaxFileSize), http.StatusRequestEntityTooLarge, "")
+	x.expect(x.tusCreate("unknown", 5), 404, "")
+
+	x.expect(x.tusCreate(token, 5), 201, "")
+	res := x.do(http.MethodPatch, "/upload/"+token, http.Header{"Tus-Resumable": {tusVersion}, "Upload-Offset": {"0"}}, "hello")
+	x.expect(res, http.StatusUnsupportedMediaType, "")
+	x.expect(x.tusPatch(token, 0, "hello, world", ""), http.StatusRequestEntityTooLarge, "Upload exceeds Upload-Length")
+}
@@ -0,0 +1,191 @@
+package routes
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"ezcp.io/ezcp-server/db"
+	"github.com/gorilla/mux"
+)
+
+// Webhook receives the payment provider's notifications of incoming transactions,
+// and mints the permanent token when a transaction pays to an address from /bitcoin.
+// BitGo calls it with {"type": "transaction", "hash": "..."}, the URL must contain ?secret=...
+func (h *Handler) Webhook(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if req.Method != http.MethodPost {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	secret := req.URL.Query().Get("secret")
+	if h.settings.WebhookSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(h.settings.WebhookSecret)) != 1 {
+		res.WriteHeader(401)
+		return
+	}
+
+	var notification struct {
+		Type string `json:"type"`
+		Hash string `json:"hash"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&notification); err != nil || notification.Hash == "" {
+		res.WriteHeader(400)
+		res.Write([]byte("Invalid notification"))
+		return
+	}
+	if notification.Type != "" && notification.Type != "transaction" {
+		res.WriteHeader(200)
+		return
+	}
+
+	address, err := h.settlePayment(ctx, notification.Hash, nil)
+	if err != nil && !isInvalidPayment(err) {
+		// the provider retries, until the payment is recorded
+		h.internalError(res, err)
+		return
+	}
+	if err != nil {
+		// the provider shouldn't retry for a transaction that isn't valid, the claim will report it
+		log.Print("Webhook for transaction ", notification.Hash, ": ", err)
+	} else if address != nil && address.Token != "" {
+		log.Print("Permanent token minted for ", address.Address)
+	}
+	res.WriteHeader(200)
+}
+
+// Claim returns the permanent token paid or renewed by an address from /bitcoin, it needs the
+// X-Ezcp-Claim-Secret returned with the address.
+// It answers 202 until the payment is received and confirmed.
+func (h *Handler) Claim(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if req.Method != http.MethodGet {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	address, err := h.db.FindAddress(ctx, mux.Vars(req)["address"])
+	if err != nil {
+		h.internalError(res, err)
+		return
+	}
+	if address == nil {
+		res.WriteHeader(404)
+		res.Write([]byte("Address not found"))
+		return
+	}
+	if address.Secret == "" {
+		res.WriteHeader(404)
+		res.Write([]byte("Address has no claim secret, get its token with POST /token/{tx}"))
+		return
+	}
+	secret := req.Header.Get(claimSecretHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(address.Secret)) != 1 {
+		res.WriteHeader(401)
+		return
+	}
+
+	if address.Token == "" && address.TxID != "" {
+		// maybe confirmed since the webhook was called
+		address, err = h.settlePayment(ctx, address.TxID, address)
+		if err != nil && !isInvalidPayment(err) {
+			h.internalError(res, err)
+			return
+		}
+		if err != nil {
+			res.WriteHeader(401)
+			res.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	switch {
+	case address.Token != "":
+		res.WriteHeader(200)
+		res.Write([]byte(address.Token))
+	case address.TxID != "":
+		res.WriteHeader(202)
+		res.Write([]byte(db.ErrPending.Error()))
+	default:
+		res.WriteHeader(202)
+		res.Write([]byte("Awaiting payment"))
+	}
+}
+
+// settlePayment checks a transaction, and mints its permanent token, or renews the token the address
+// is tied to, if it pays to an address we handed out. address is looked up from the transaction outputs when nil.
+// It returns the updated address, or nil if the transaction doesn't pay to one of them.
+// The errors of transactions which don't pay are invalidPayment, other errors are worth retrying.
+func (h *Handler) settlePayment(ctx context.Context, txid string, address *db.Address) (*db.Address, error) {
+	tx, err := h.db.LoadTransaction(ctx, txid)
+	if err != nil {
+		return nil, err
+	}
+	cached := tx != nil
+	if !cached {
+		tx, err = h.payment.LookupTransaction(txid)
+		if err != nil || tx == nil {
+			return address, err
+		}
+	}
+
+	if address == nil {
+		address, err = h.paidAddress(ctx, tx)
+		if err != nil || address == nil {
+			return nil, err
+		}
+	}
+	return h.settle(ctx, tx, cached, address)
+}
+
+// paidAddress returns the address from /bitcoin a transaction pays to, or nil
+func (h *Handler) paidAddress(ctx context.Context, tx *db.Transaction) (*db.Address, error) {
+	var accounts []string
+	for _, output := range tx.Outputs {
+		if output.IsMine {
+			accounts = append(accounts, output.Account)
+		}
+	}
+	if len(accounts) == 0 {
+		return nil, nil
+	}
+	return h.db.FindAddress(ctx, accounts...)
+}
+
+// settle is settlePayment of a transaction paying to address, cached if it already minted or renewed its token
+func (h *Handler) settle(ctx context.Context, tx *db.Transaction, cached bool, address *db.Address) (*db.Address, error) {
+	var err error
+	address.TxID = tx.ID
+
+	if cached {
+		// the token was already minted, unless it was revoked since
+		if _, err = h.checkPayment(ctx, tx, nil, 0); err != nil && err != db.ErrPending {
+			return address, err
+		}
+	} else {
+		plan, err := h.checkPayment(ctx, tx, address, h.settings.MinConfirmations)
+		if err == db.ErrPending {
+			return address, h.db.AddressPaid(ctx, address.Address, tx.ID, "")
+		}
+		if err != nil {
+			h.db.AddressPaid(ctx, address.Address, tx.ID, "")
+			return address, err
+		}
+		if address.Secret != "" {
+			tx.Address = address.Address
+		}
+		if address.Renews != "" {
+			tx, err = h.renewToken(ctx, tx, plan, address.Renews)
+		} else {
+			tx, err = h.issueToken(ctx, tx, plan)
+		}
+		if err != nil {
+			return address, err
+		}
+	}
+
+	address.Token = *tx.Token
+	return address, h.db.AddressPaid(ctx, address.Address, tx.ID, address.Token)
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// FreeSpace returns the bytes available to unprivileged users on the filesystem of path,
+// which may not exist yet
+func FreeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(existingParent(path), &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
+
+// Filesystem identifies the filesystem of path, which may not exist yet, by its device
+func Filesystem(path string) (string, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(existingParent(path), &stat); err != nil {
+		return "", err
+	}
+	return fmt.Sprint(stat.Dev), nil
+}
@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// FreeSpace returns the bytes available to the user on the volume of path, which may not exist yet
+func FreeSpace(path string) (uint64, error) {
+	pathPtr, err := syscall.UTF16PtrFromString(existingParent(path))
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	proc := syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+	ret, _, err := proc.Call(uintptr(unsafe.Pointer(pathPtr)), uintptr(unsafe.Pointer(&free)), 0, 0)
+	if ret == 0 {
+		return 0, err
+	}
+	return free, nil
+}
+
+// Filesystem identifies the volume of path, which may not exist yet
+func Filesystem(path string) (string, error) {
+	abs, err := filepath.Abs(existingParent(path))
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(filepath.VolumeName(abs)), nil
+}
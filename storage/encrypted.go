@@ -0,0 +1,526 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted files are made of a header and the file in chunks encrypted with AES-256-GCM:
+//
+//	magic "EZCE", version 1, key ID length, key ID of the master key,
+//	nonce and data key encrypted by the master key, nonce prefix of the chunks
+//
+// Each chunk's nonce is the prefix, the chunk index and whether it is the last chunk,
+// so chunks can't be reordered or dropped. Its additional data is the header and the token,
+// so the header can't be altered nor the file swapped with another token's. There is at least one chunk, even if empty.
+const (
+	encryptedMagic   = "EZCE"
+	encryptedVersion = 1
+
+	// encryptedChunkSize is the size of the plaintext of every chunk but the last
+	encryptedChunkSize = 64 * 1024
+
+	dataKeySize     = 32
+	noncePrefixSize = 7
+)
+
+var (
+	// ErrUnknownKey is returned when a file was encrypted with a master key which isn't in the Keyring
+	ErrUnknownKey = errors.New("Unknown encryption key")
+
+	// ErrNotEncrypted is returned when reading a file stored unencrypted, unless migrating plaintext files
+	ErrNotEncrypted = errors.New("File isn't encrypted")
+
+	errCorrupted = errors.New("Corrupted encrypted file")
+)
+
+// Keyring holds the master keys, by ID. Current encrypts the data keys of new files,
+// the others are kept to read the files encrypted before a rotation.
+type Keyring struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+// NewKeyring returns a Keyring of base64 keys, and of the keys of keyFile unless empty.
+// Every key is 32 bytes, for AES-256.
+func NewKeyring(current string, keys map[string]string, keyFile string) (*Keyring, error) {
+	keyring := &Keyring{current, make(map[string][]byte)}
+	for id, encoded := range keys {
+		if err := keyring.add(id, encoded); err != nil {
+			return nil, err
+		}
+	}
+	if keyFile != "" {
+		if err := keyring.readFile(keyFile); err != nil {
+			return nil, err
+		}
+	}
+	if keyring.Keys[current] == nil {
+		return nil, errors.New("Missing current encryption key " + current)
+	}
+	return keyring, nil
+}
+
+// readFile reads a key file, of "id base64-key" lines, with # comments
+func (k *Keyring) readFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return errors.New("Invalid line in key file " + path)
+		}
+		if err = k.add(fields[0], fields[1]); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (k *Keyring) add(id string, encoded string) error {
+	if id == "" || len(id) > 255 {
+		return errors.New("Invalid encryption key ID " + id)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return errors.New("Encryption key " + id + " must be 32 bytes in base64")
+	}
+	k.Keys[id] = key
+	return nil
+}
+
+// Encrypted is a Storage wrapper which encrypts files at rest, with a data key per file.
+type Encrypted struct {
+	inner     Storage
+	keyring   *Keyring
+	plaintext bool
+}
+
+// NewEncrypted returns a Storage encrypting the files stored in inner.
+// Files stored unencrypted are refused with ErrNotEncrypted, unless migrating plaintext: then the files
+// stored before encryption was enabled are read as they are, until RotateKey encrypts them.
+func NewEncrypted(inner Storage, keyring *Keyring, plaintext bool) *Encrypted {
+	return &Encrypted{inner, keyring, plaintext}
+}
+
+// header is the decoded header of an encrypted file
+type header struct {
+	keyID  string
+	key    []byte // the data key
+	prefix []byte
+	raw    []byte // the encoded header
+}
+
+// additionalData returns the additional data of the chunks of the file of token
+func (h *header) additionalData(token string) []byte {
+	return append(append([]byte(nil), h.raw...), token...)
+}
+
+// newHeader generates a data key, and encodes it encrypted by the current master key
+func (e *Encrypted) newHeader() (*header, []byte, error) {
+	h := &header{keyID: e.keyring.Current, key: make([]byte, dataKeySize), prefix: make([]byte, noncePrefixSize)}
+	if _, err := rand.Read(h.key); err != nil {
+		return nil, nil, err
+	}
+	if _, err := rand.Read(h.prefix); err != nil {
+		return nil, nil, err
+	}
+	encoded, err := e.encodeHeader(h)
+	return h, encoded, err
+}
+
+// encodeHeader encrypts the data key of h with the current master key
+func (e *Encrypted) encodeHeader(h *header) ([]byte, error) {
+	master, err := newGCM(e.keyring.Keys[e.keyring.Current])
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, master.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+	buffer.WriteString(encryptedMagic)
+	buffer.WriteByte(encryptedVersion)
+	buffer.WriteByte(byte(len(e.keyring.Current)))
+	buffer.WriteString(e.keyring.Current)
+	buffer.Write(nonce)
+	buffer.Write(master.Seal(nil, nonce, h.key, []byte(e.keyring.Current)))
+	buffer.Write(h.prefix)
+	h.keyID = e.keyring.Current
+	h.raw = buffer.Bytes()
+	return h.raw, nil
+}
+
+// readHeader decodes the header at the start of r, it returns nil for files stored unencrypted
+func (e *Encrypted) readHeader(r io.Reader) (*header, error) {
+	start := make([]byte, len(encryptedMagic)+2)
+	if _, err := io.ReadFull(r, start); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if string(start[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, nil
+	}
+	if start[len(encryptedMagic)] != encryptedVersion {
+		return nil, errCorrupted
+	}
+
+	rest := make([]byte, int(start[len(encryptedMagic)+1])+12+dataKeySize+16+noncePrefixSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, errCorrupted
+	}
+	idSize := int(start[len(encryptedMagic)+1])
+	h := &header{keyID: string(rest[:idSize]), raw: append(start, rest...)}
+	masterKey := e.keyring.Keys[h.keyID]
+	if masterKey == nil {
+		return nil, ErrUnknownKey
+	}
+	master, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := rest[idSize : idSize+12]
+	wrapped := rest[idSize+12 : idSize+12+dataKeySize+16]
+	if h.key, err = master.Open(nil, nonce, wrapped, []byte(h.keyID)); err != nil {
+		return nil, errCorrupted
+	}
+	h.prefix = rest[len(rest)-noncePrefixSize:]
+	return h, nil
+}
+
+// Put stores the content of r for token, encrypted
+func (e *Encrypted) Put(token string, r io.Reader) (int64, error) {
+	return put(e, token, r)
+}
+
+// Prepare encrypts the content of r for token, and returns the number of plaintext bytes
+func (e *Encrypted) Prepare(token string, r io.Reader) (Pending, int64, error) {
+	return e.prepare(token, r, nil)
+}
+
+// Replace encrypts the content of r for token like Prepare, to replace the file described by previous.
+// previous describes the stored file as List returns it, with the size of its encrypted content.
+func (e *Encrypted) Replace(token string, r io.Reader, previous *Info) (Pending, int64, error) {
+	return e.prepare(token, r, previous)
+}
+
+func (e *Encrypted) prepare(token string, r io.Reader, previous *Info) (Pending, int64, error) {
+	h, encoded, err := e.newHeader()
+	if err != nil {
+		return nil, 0, err
+	}
+	aead, err := newGCM(h.key)
+	if err != nil {
+		return nil, 0, err
+	}
+	encrypter := &encrypter{r: r, aead: aead, prefix: h.prefix, additional: h.additionalData(token), out: encoded}
+	var p Pending
+	if previous == nil {
+		p, _, err = e.inner.Prepare(token, encrypter)
+	} else {
+		p, _, err = e.inner.Replace(token, encrypter, previous)
+	}
+	return p, encrypter.read, err
+}
+
+// Get opens the file stored for token, and decrypts it as it is read
+func (e *Encrypted) Get(token string) (File, error) {
+	file, err := e.inner.Get(token)
+	if err != nil {
+		return nil, err
+	}
+	h, err := e.readHeader(file)
+	if err == nil && h == nil && e.plaintext {
+		_, err = file.Seek(0, io.SeekStart)
+		return file, err // stored before encryption was enabled
+	}
+	if err == nil && h == nil {
+		err = ErrNotEncrypted
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	stored, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	size, err := plaintextSize(stored - int64(len(h.raw)))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	aead, err := newGCM(h.key)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &decrypter{file: file, aead: aead, header: h, additional: h.additionalData(token), size: size, chunk: -1}, nil
+}
+
+// Delete removes the file stored for token
+func (e *Encrypted) Delete(token string) error {
+	return e.inner.Delete(token)
+}
+
+// Stat returns information about the file stored for token, with its plaintext size
+func (e *Encrypted) Stat(token string) (*Info, error) {
+	info, err := e.inner.Stat(token)
+	if err != nil {
+		return nil, err
+	}
+	file, err := e.Get(token)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return &Info{token, size, info.Modified, info.Version}, nil
+}
+
+// List returns every stored file, with the size of their encrypted content
+func (e *Encrypted) List() ([]Info, error) {
+	return e.inner.List()
+}
+
+// RotateKey re-encrypts the file stored for token with a new data key, encrypted by the current master key.
+// Files stored unencrypted are encrypted when migrating plaintext.
+// It returns false if the file was already up to date, or was replaced or deleted during the rotation:
+// the rewritten file only replaces the one which was read.
+func (e *Encrypted) RotateKey(token string) (bool, error) {
+	before, err := e.inner.Stat(token)
+	if err != nil {
+		return false, err
+	}
+	stored, err := e.inner.Get(token)
+	if err != nil {
+		return false, err
+	}
+	h, err := e.readHeader(stored)
+	stored.Close()
+	if err != nil {
+		return false, err
+	}
+	if h != nil && h.keyID == e.keyring.Current {
+		return false, nil
+	}
+
+	file, err := e.Get(token)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	p, _, err := e.prepare(token, file, before)
+	if err != nil {
+		return false, err
+	}
+
+	err = p.Commit()
+	if err == ErrModified {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// plaintextSize returns the size of the plaintext of size bytes of encrypted chunks
+func plaintextSize(size int64) (int64, error) {
+	const sealed = encryptedChunkSize + 16
+	full, rest := size/sealed, size%sealed
+	if rest == 0 && full > 0 {
+		return full * encryptedChunkSize, nil
+	}
+	if rest < 16 {
+		return 0, errCorrupted
+	}
+	return full*encryptedChunkSize + rest - 16, nil
+}
+
+// chunkNonce returns the nonce of a chunk: the file's prefix, the chunk index, and 1 for the last chunk
+func chunkNonce(prefix []byte, index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], uint32(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypter reads r encrypted in chunks, after the header in out
+type encrypter struct {
+	r          io.Reader
+	aead       cipher.AEAD
+	prefix     []byte
+	additional []byte
+
+	out   []byte // encrypted, not read yet
+	index int64
+	read  int64 // plaintext bytes
+	done  bool
+
+	// next is read ahead, to know whether the current chunk is the last one
+	next    []byte
+	started bool
+}
+
+func (e *encrypter) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// seal encrypts the next chunk
+func (e *encrypter) seal() error {
+	if !e.started {
+		e.started = true
+		chunk, err := e.readChunk()
+		if err != nil {
+			return err
+		}
+		e.next = chunk
+	}
+	current := e.next
+	last := len(current) < encryptedChunkSize
+	if !last {
+		chunk, err := e.readChunk()
+		if err != nil {
+			return err
+		}
+		e.next = chunk
+		last = len(chunk) == 0
+	}
+	e.out = e.aead.Seal(nil, chunkNonce(e.prefix, e.index, last), current, e.additional)
+	e.read += int64(len(current))
+	e.index++
+	e.done = last
+	return nil
+}
+
+func (e *encrypter) readChunk() ([]byte, error) {
+	chunk := make([]byte, encryptedChunkSize)
+	n, err := io.ReadFull(e.r, chunk)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return chunk[:n], err
+}
+
+// decrypter is a File decrypting the chunks it reads, seeking reads only the chunks needed
+type decrypter struct {
+	file       File
+	aead       cipher.AEAD
+	header     *header
+	additional []byte
+	size       int64 // plaintext
+	offset     int64
+
+	chunk     int64 // index of the chunk in plain, or -1
+	plain     []byte
+	sealedBuf []byte
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	if d.offset >= d.size {
+		return 0, io.EOF
+	}
+	index := d.offset / encryptedChunkSize
+	if index != d.chunk {
+		if err := d.open(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain[d.offset-index*encryptedChunkSize:])
+	d.offset += int64(n)
+	return n, nil
+}
+
+// open reads and decrypts a chunk
+func (d *decrypter) open(index int64) error {
+	start := index * encryptedChunkSize
+	length := d.size - start
+	if length > encryptedChunkSize {
+		length = encryptedChunkSize
+	}
+	last := start+length == d.size
+
+	if _, err := d.file.Seek(int64(len(d.header.raw))+index*(encryptedChunkSize+16), io.SeekStart); err != nil {
+		return err
+	}
+	if d.sealedBuf == nil {
+		d.sealedBuf = make([]byte, encryptedChunkSize+16)
+	}
+	sealed := d.sealedBuf[:length+16]
+	if _, err := io.ReadFull(d.file, sealed); err != nil {
+		return err
+	}
+	plain, err := d.aead.Open(d.plain[:0], chunkNonce(d.header.prefix, index, last), sealed, d.additional)
+	if err != nil {
+		d.chunk = -1
+		return errCorrupted
+	}
+	d.plain, d.chunk = plain, index
+	return nil
+}
+
+func (d *decrypter) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.offset
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return d.offset, errors.New("Invalid whence")
+	}
+	if offset < 0 {
+		return d.offset, errors.New("Negative position")
+	}
+	d.offset = offset
+	return offset, nil
+}
+
+func (d *decrypter) Close() error {
+	return d.file.Close()
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+var (
+	oldKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	newKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+)
+
+func newTestKeyring(t *testing.T, current string, keys map[string]string) *Keyring {
+	keyring, err := NewKeyring(current, keys, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyring
+}
+
+func readAll(s Storage, token string) ([]byte, error) {
+	file, err := s.Get(token)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ioutil.ReadAll(file)
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	inner := NewMemory()
+	encrypted := NewEncrypted(inner, newTestKeyring(t, "old", map[string]string{"old": oldKey}), false)
+
+	for _, size := range []int{0, 1, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1, 2 * encryptedChunkSize} {
+		data := randomData(size)
+		n, err := encrypted.Put("roundtrip", bytes.NewReader(data))
+		if err != nil || n != int64(size) {
+			t.Fatalf("Put of %d bytes = %d, %v", size, n, err)
+		}
+		read, err := readAll(encrypted, "roundtrip")
+		if err != nil || !bytes.Equal(read, data) {
+			t.Errorf("%d bytes read back as %d bytes, %v", size, len(read), err)
+		}
+		if info := stat(t, encrypted, "roundtrip"); info.Size != int64(size) {
+			t.Errorf("Stat of %d bytes = %d", size, info.Size)
+		}
+
+		stored, _ := readAll(inner, "roundtrip")
+		if size >= 16 && bytes.Contains(stored, data) {
+			t.Errorf("%d bytes are stored in plaintext", size)
+		}
+	}
+}
+
+func TestEncryptedRange(t *testing.T) {
+	encrypted := NewEncrypted(NewMemory(), newTestKeyring(t, "old", map[string]string{"old": oldKey}), false)
+	data := randomData(3*encryptedChunkSize + 1234)
+	encrypted.Put("range000", bytes.NewReader(data))
+	checkRanges(t, encrypted, "range000", data)
+}
+
+func TestEncryptedTruncated(t *testing.T) {
+	inner := NewMemory()
+	encrypted := NewEncrypted(inner, newTestKeyring(t, "old", map[string]string{"old": oldKey}), false)
+
+	for _, size := range []int{2 * encryptedChunkSize, 2*encryptedChunkSize + 1} {
+		encrypted.Put("truncate", bytes.NewReader(randomData(size)))
+		stored, _ := readAll(inner, "truncate")
+
+		// drop the chunks after the first one, the first chunk isn't marked as the last one
+		header := len(stored) - size - 16*((size+encryptedChunkSize-1)/encryptedChunkSize)
+		inner.Put("truncate", bytes.NewReader(stored[:header+encryptedChunkSize+16]))
+		if _, err := readAll(encrypted, "truncate"); err == nil {
+			t.Errorf("%d bytes truncated at a chunk boundary were read", size)
+		}
+	}
+
+	// a chunk cut in the middle
+	encrypted.Put("truncate", bytes.NewReader(randomData(1000)))
+	stored, _ := readAll(inner, "truncate")
+	inner.Put("truncate", bytes.NewReader(stored[:len(stored)-100]))
+	if _, err := readAll(encrypted, "truncate"); err == nil {
+		t.Error("a truncated chunk was read")
+	}
+}
+
+func TestEncryptedTampered(t *testing.T) {
+	inner := NewMemory()
+	encrypted := NewEncrypted(inner, newTestKeyring(t, "old", map[string]string{"old": oldKey}), false)
+	encrypted.Put("tampered", strings.NewReader("hello"))
+	stored, _ := readAll(inner, "tampered")
+	stored[len(stored)-1] ^= 1
+	inner.Put("tampered", bytes.NewReader(stored))
+	if _, err := readAll(encrypted, "tampered"); err == nil {
+		t.Error("a tampered file was read")
+	}
+}
+
+func TestEncryptedSwapped(t *testing.T) {
+	inner := NewMemory()
+	encrypted := NewEncrypted(inner, newTestKeyring(t, "old", map[string]string{"old": oldKey}), false)
+	encrypted.Put("swapped0", strings.NewReader("hello"))
+	encrypted.Put("swapped1", strings.NewReader("world"))
+
+	// the file of another token
+	stored, _ := readAll(inner, "swapped1")
+	inner.Put("swapped0", bytes.NewReader(stored))
+	if _, err := readAll(encrypted, "swapped0"); err == nil {
+		t.Error("a file swapped from another token was read")
+	}
+}
+
+func TestEncryptedRotateKey(t *testing.T) {
+	inner := NewMemory()
+	data := randomData(encryptedChunkSize + 1)
+	NewEncrypted(inner, newTestKeyring(t, "old", map[string]string{"old": oldKey}), false).Put("rotated0", bytes.NewReader(data))
+
+	// after the rotation to the new key, files are still read with the old key until rotated
+	rotation := NewEncrypted(inner, newTestKeyring(t, "new", map[string]string{"old": oldKey, "new": newKey}), false)
+	if read, err := readAll(rotation, "rotated0"); err != nil || !bytes.Equal(read, data) {
+		t.Fatalf("read with the old key = %d bytes, %v", len(read), err)
+	}
+	done, err := rotation.RotateKey("rotated0")
+	if err != nil || !done {
+		t.Fatalf("RotateKey = %v, %v", done, err)
+	}
+	if done, err = rotation.RotateKey("rotated0"); err != nil || done {
+		t.Errorf("second RotateKey = %v, %v, want it up to date", done, err)
+	}
+
+	// the old key can be dropped
+	newOnly := NewEncrypted(inner, newTestKeyring(t, "new", map[string]string{"new": newKey}), false)
+	if read, err := readAll(newOnly, "rotated0"); err != nil || !bytes.Equal(read, data) {
+		t.Errorf("read with the new key = %d bytes, %v", len(read), err)
+	}
+	oldOnly := NewEncrypted(inner, newTestKeyring(t, "old", map[string]string{"old": oldKey}), false)
+	if _, err = readAll(oldOnly, "rotated0"); err != ErrUnknownKey {
+		t.Errorf("read with the old key = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestEncryptedRotateUnencrypted(t *testing.T) {
+	inner := NewMemory()
+	inner.Put("plain000", strings.NewReader("stored before encryption"))
+	keyring := newTestKeyring(t, "old", map[string]string{"old": oldKey})
+
+	// unencrypted files can't be told apart from tampered ones, unless migrating
+	refusing := NewEncrypted(inner, keyring, false)
+	if _, err := readAll(refusing, "plain000"); err != ErrNotEncrypted {
+		t.Errorf("unencrypted file read: %v, want ErrNotEncrypted", err)
+	}
+	if _, err := refusing.RotateKey("plain000"); err != ErrNotEncrypted {
+		t.Errorf("RotateKey = %v, want ErrNotEncrypted", err)
+	}
+
+	encrypted := NewEncrypted(inner, keyring, true)
+
+	if read, err := readAll(encrypted, "plain000"); err != nil || string(read) != "stored before encryption" {
+		t.Fatalf("unencrypted file read as %q, %v", read, err)
+	}
+	if done, err := encrypted.RotateKey("plain000"); err != nil || !done {
+		t.Fatalf("RotateKey = %v, %v", done, err)
+	}
+	if stored, _ := readAll(inner, "plain000"); bytes.Contains(stored, []byte("stored before encryption")) {
+		t.Error("the file wasn't encrypted")
+	}
+	if read, err := readAll(encrypted, "plain000"); err != nil || string(read) != "stored before encryption" {
+		t.Errorf("encrypted file read as %q, %v", read, err)
+	}
+}
+
+// racingStorage runs during after writing a replacement, before it is committed
+type racingStorage struct {
+	Storage
+	during func()
+}
+
+func (r *racingStorage) Replace(token string, reader io.Reader, previous *Info) (Pending, int64, error) {
+	p, n, err := r.Storage.Replace(token, reader, previous)
+	r.during()
+	return p, n, err
+}
+
+func TestEncryptedRotateKeyRace(t *testing.T) {
+	inner := NewMemory()
+	NewEncrypted(inner, newTestKeyring(t, "old", map[string]string{"old": oldKey}), false).Put("deleted0", strings.NewReader("hello"))
+	NewEncrypted(inner, newTestKeyring(t, "old", map[string]string{"old": oldKey}), false).Put("uploaded", strings.NewReader("hello"))
+	keyring := newTestKeyring(t, "new", map[string]string{"old": oldKey, "new": newKey})
+
+	// a file deleted during the rotation doesn't come back
+	racing := &racingStorage{inner, func() { inner.Delete("deleted0") }}
+	done, err := NewEncrypted(racing, keyring, false).RotateKey("deleted0")
+	if err != nil || done {
+		t.Errorf("RotateKey = %v, %v, want false", done, err)
+	}
+	if _, err = inner.Stat("deleted0"); err != ErrNotFound {
+		t.Errorf("Stat = %v, want ErrNotFound", err)
+	}
+
+	// nor does a file uploaded during the rotation get overwritten
+	encrypted := NewEncrypted(inner, keyring, false)
+	racing = &racingStorage{inner, func() { encrypted.Put("uploaded", strings.NewReader("new upload")) }}
+	done, err = NewEncrypted(racing, keyring, false).RotateKey("uploaded")
+	if err != nil || done {
+		t.Errorf("RotateKey = %v, %v, want false", done, err)
+	}
+	if read, _ := readAll(encrypted, "uploaded"); string(read) != "new upload" {
+		t.Errorf("read %q, want the new upload", read)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	if _, err := NewKeyring("missing", map[string]string{"old": oldKey}, ""); err == nil {
+		t.Error("NewKeyring accepted a missing current key")
+	}
+	if _, err := NewKeyring("short", map[string]string{"short": "c2hvcnQ="}, ""); err == nil {
+		t.Error("NewKeyring accepted a short key")
+	}
+
+	path := t.TempDir() + "/keys"
+	ioutil.WriteFile(path, []byte("# keys\nold "+oldKey+"\n\nnew "+newKey+"\n"), 0600)
+	keyring, err := NewKeyring("new", nil, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keyring.Keys) != 2 {
+		t.Errorf("%d keys read, want 2", len(keyring.Keys))
+	}
+}
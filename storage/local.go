@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultPath is the default storage location path for EZCP
+const DefaultPath = "ezcp-storage/"
+
+// Local stores files on the local filesystem, sharded by token prefix
+// e.g. ezcp-storage/xxx/yy/xxxyy...
+type Local struct {
+	root string
+}
+
+// NewLocal returns a new Local storage rooted at path
+func NewLocal(path string) *Local {
+	return &Local{path}
+}
+
+// FreeSpace returns the bytes available on the filesystem of the storage
+func (l *Local) FreeSpace() (uint64, error) {
+	return FreeSpace(l.root)
+}
+
+// Filesystem identifies the filesystem of the storage
+func (l *Local) Filesystem() (string, error) {
+	return Filesystem(l.root)
+}
+
+// existingParent returns path, or its closest parent directory which exists
+func existingParent(path string) string {
+	path = filepath.Clean(path)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+// Put stores the content of r for token
+func (l *Local) Put(token string, r io.Reader) (int64, error) {
+	return put(l, token, r)
+}
+
+// Prepare writes the content of r for token to a hidden temporary file next to its file,
+// which is renamed over it on commit
+func (l *Local) Prepare(token string, r io.Reader) (Pending, int64, error) {
+	return l.prepare(token, r, nil)
+}
+
+// Replace writes the content of r for token like Prepare, it is renamed over the file on commit if it is still previous
+func (l *Local) Replace(token string, r io.Reader, previous *Info) (Pending, int64, error) {
+	return l.prepare(token, r, previous)
+}
+
+func (l *Local) prepare(token string, r io.Reader, previous *Info) (Pending, int64, error) {
+	path, err := l.path(token)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, 0, err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+token+".")
+	if err != nil {
+		return nil, 0, err
+	}
+	n, err := io.Copy(file, r)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, n, err
+	}
+	return l.pending(token, path, file.Name(), previous, func() error { return os.Remove(file.Name()) }), n, nil
+}
+
+// PrepareFile moves the file at source next to the file of token, it is renamed over it on commit.
+// It is copied instead if it can't be moved, from another filesystem.
+func (l *Local) PrepareFile(token string, source string) (Pending, int64, error) {
+	path, err := l.path(token)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, 0, err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+token+".")
+	if err != nil {
+		return nil, 0, err
+	}
+	temp := file.Name()
+	file.Close()
+	if err = os.Rename(source, temp); err != nil {
+		os.Remove(temp)
+		copied, err := os.Open(source)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer copied.Close()
+		return l.prepare(token, copied, nil)
+	}
+	moveBack := func() error { return os.Rename(temp, source) }
+
+	// the file may not have been synced yet
+	file, err = os.OpenFile(temp, os.O_WRONLY, 0)
+	if err != nil {
+		moveBack()
+		return nil, 0, err
+	}
+	err = file.Sync()
+	fileinfo, statErr := file.Stat()
+	if err == nil {
+		err = statErr
+	}
+	file.Close()
+	if err != nil {
+		moveBack()
+		return nil, 0, err
+	}
+	return l.pending(token, path, temp, nil, moveBack), fileinfo.Size(), nil
+}
+
+// pending returns the Pending of a temporary file, which is renamed over the file of token at path on commit
+func (l *Local) pending(token string, path string, temp string, previous *Info, abort func() error) Pending {
+	commit := func() error {
+		unlock, err := l.lock()
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		if previous != nil {
+			current, err := l.Stat(token)
+			if err == ErrNotFound || err == nil && !previous.same(current) {
+				err = ErrModified
+			}
+			if err != nil {
+				os.Remove(temp)
+				return err
+			}
+		}
+		return os.Rename(temp, path)
+	}
+	return &pending{commit: commit, abort: abort}
+}
+
+// Get opens the file stored for token
+func (l *Local) Get(token string) (File, error) {
+	path, err := l.path(token)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Delete removes the file stored for token
+func (l *Local) Delete(token string) error {
+	path, err := l.path(token)
+	if err != nil {
+		return err
+	}
+	unlock, err := l.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Stat returns information about the file stored for token
+func (l *Local) Stat(token string) (*Info, error) {
+	path, err := l.path(token)
+	if err != nil {
+		return nil, err
+	}
+	fileinfo, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Info{token, fileinfo.Size(), fileinfo.ModTime(), ""}, nil
+}
+
+// List walks the storage tree and returns every stored file
+func (l *Local) List() ([]Info, error) {
+	var result []Info
+	err := filepath.Walk(l.root, func(path string, fileinfo os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == l.root {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if fileinfo.IsDir() || strings.HasPrefix(fileinfo.Name(), ".") { // temporary files
+			return nil
+		}
+		result = append(result, Info{fileinfo.Name(), fileinfo.Size(), fileinfo.ModTime(), ""})
+		return nil
+	})
+	return result, err
+}
+
+// lock takes the lock of the storage, which is shared by every process using it.
+// Commits and deletions hold it, so Replace checks and replaces a file before anything else changes it.
+func (l *Local) lock() (func(), error) {
+	if err := os.MkdirAll(l.root, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(l.root, ".lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(file)
+		file.Close()
+	}, nil
+}
+
+// path returns the complete path for a token
+func (l *Local) path(token string) (string, error) {
+	if len(token) < 5 || filepath.Base(token) != token {
+		return "", errors.New("Invalid token")
+	}
+	first3 := token[0:3]
+	next2 := token[3:5]
+	return filepath.Join(l.root, first3, next2, token), nil
+}
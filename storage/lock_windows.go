@@ -0,0 +1,30 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const lockfileExclusiveLock = 2
+
+var kernel32 = syscall.NewLazyDLL("kernel32.dll")
+
+// lockFile takes an exclusive lock on file, waiting for other processes to release it
+func lockFile(file *os.File) error {
+	var overlapped syscall.Overlapped
+	ret, _, err := kernel32.NewProc("LockFileEx").Call(file.Fd(), lockfileExclusiveLock, 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if ret == 0 {
+		return err
+	}
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	var overlapped syscall.Overlapped
+	ret, _, err := kernel32.NewProc("UnlockFileEx").Call(file.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(&overlapped)))
+	if ret == 0 {
+		return err
+	}
+	return nil
+}
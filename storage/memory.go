@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory stores files in memory, it is meant for tests
+type Memory struct {
+	mutex sync.RWMutex
+	files map[string]memoryFile
+}
+
+type memoryFile struct {
+	data     []byte
+	modified time.Time
+}
+
+// memoryReader makes a bytes.Reader a File
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
+
+// NewMemory returns a new empty Memory storage
+func NewMemory() *Memory {
+	return &Memory{files: make(map[string]memoryFile)}
+}
+
+// Put stores the content of r for token
+func (m *Memory) Put(token string, r io.Reader) (int64, error) {
+	return put(m, token, r)
+}
+
+// Prepare reads the content of r for token, which is stored on commit
+func (m *Memory) Prepare(token string, r io.Reader) (Pending, int64, error) {
+	return m.prepare(token, r, nil)
+}
+
+// Replace reads the content of r for token, which is stored on commit if the file is still previous
+func (m *Memory) Replace(token string, r io.Reader, previous *Info) (Pending, int64, error) {
+	return m.prepare(token, r, previous)
+}
+
+func (m *Memory) prepare(token string, r io.Reader, previous *Info) (Pending, int64, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, int64(len(data)), err
+	}
+
+	commit := func() error {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		if previous != nil {
+			file, ok := m.files[token]
+			if !ok || !previous.same(&Info{token, int64(len(file.data)), file.modified, ""}) {
+				return ErrModified
+			}
+		}
+		m.files[token] = memoryFile{data, time.Now()}
+		return nil
+	}
+	return &pending{commit, func() error { return nil }}, int64(len(data)), nil
+}
+
+// Get opens the file stored for token
+func (m *Memory) Get(token string) (File, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	file, ok := m.files[token]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return memoryReader{bytes.NewReader(file.data)}, nil
+}
+
+// Delete removes the file stored for token
+func (m *Memory) Delete(token string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.files[token]; !ok {
+		return ErrNotFound
+	}
+	delete(m.files, token)
+	return nil
+}
+
+// Stat returns information about the file stored for token
+func (m *Memory) Stat(token string) (*Info, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	file, ok := m.files[token]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &Info{token, int64(len(file.data)), file.modified, ""}, nil
+}
+
+// List returns every stored file, sorted by token
+func (m *Memory) List() ([]Info, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	var result []Info
+	for token, file := range m.files {
+		result = append(result, Info{token, int64(len(file.data)), file.modified, ""})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Token < result[j].Token })
+	return result, nil
+}
@@ -0,0 +1,491 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3PartSize is the size of the parts of a multipart upload, 5MiB is the minimum allowed by S3
+	s3PartSize = 5 * 1024 * 1024
+
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// S3Config configures an S3 storage
+type S3Config struct {
+	Endpoint  string // e.g. https://s3.amazonaws.com or http://localhost:9000
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool   // use endpoint/bucket/key instead of bucket.endpoint/key
+	Prefix    string // optional key prefix
+
+	// Timeout bounds each request, 0 for none. Only the response headers of a download are bounded,
+	// its body can take longer.
+	Timeout time.Duration
+}
+
+// S3 stores files in an S3 compatible bucket, using the same sharded layout as Local
+type S3 struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+	ctx      context.Context // see WithContext
+}
+
+// NewS3 returns a new S3 storage
+func NewS3(config S3Config) (*S3, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, errors.New("Invalid S3 endpoint " + config.Endpoint)
+	}
+	if config.Bucket == "" {
+		return nil, errors.New("Missing S3 bucket")
+	}
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = config.Timeout
+	return &S3{config, endpoint, &http.Client{Transport: transport}, context.Background()}, nil
+}
+
+// WithContext returns the storage making its requests with ctx, they are canceled when it is done
+func (s *S3) WithContext(ctx context.Context) Storage {
+	bound := *s
+	bound.ctx = ctx
+	return &bound
+}
+
+// Put stores the content of r for token
+func (s *S3) Put(token string, r io.Reader) (int64, error) {
+	return put(s, token, r)
+}
+
+// Prepare writes the content of r for token, objects are replaced atomically by S3.
+// Small files are kept in memory and sent with a single PUT on commit, larger ones are
+// streamed with a multipart upload which is completed on commit.
+func (s *S3) Prepare(token string, r io.Reader) (Pending, int64, error) {
+	return s.prepare(token, r, nil)
+}
+
+// Replace writes the content of r for token like Prepare, it is committed with If-Match
+// the ETag of previous, so S3 refuses it if the object was replaced or deleted
+func (s *S3) Replace(token string, r io.Reader, previous *Info) (Pending, int64, error) {
+	if previous.Version == "" {
+		return nil, 0, errors.New("Missing ETag of " + token)
+	}
+	return s.prepare(token, r, http.Header{"If-Match": {previous.Version}})
+}
+
+func (s *S3) prepare(token string, r io.Reader, headers http.Header) (Pending, int64, error) {
+	key, err := s.key(token)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	part := make([]byte, s3PartSize)
+	n, err := io.ReadFull(r, part)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		commit := func() error {
+			resp, err := s.doHeaders(http.MethodPut, key, nil, bytes.NewReader(part[:n]), int64(n), headers)
+			if err != nil {
+				return conditionFailed(err, headers)
+			}
+			resp.Body.Close()
+			return nil
+		}
+		return &pending{commit, func() error { return nil }}, int64(n), nil
+	}
+	if err != nil {
+		return nil, int64(n), err
+	}
+	return s.prepareMultipart(key, part, r, headers)
+}
+
+// conditionFailed returns ErrModified for the ErrNotFound of a conditional write, the object was deleted
+func conditionFailed(err error, headers http.Header) error {
+	if err == ErrNotFound && headers.Get("If-Match") != "" {
+		return ErrModified
+	}
+	return err
+}
+
+func (s *S3) prepareMultipart(key string, first []byte, r io.Reader, headers http.Header) (Pending, int64, error) {
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	var initiate struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiate)
+	resp.Body.Close()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	type completedPart struct {
+		PartNumber int
+		ETag       string
+	}
+	var complete struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}
+
+	size := int64(len(first))
+	part := first
+	for number := 1; ; number++ {
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {initiate.UploadID}}
+		resp, err = s.do(http.MethodPut, key, query, bytes.NewReader(part), int64(len(part)))
+		if err != nil {
+			s.abortMultipart(key, initiate.UploadID)
+			return nil, size, err
+		}
+		resp.Body.Close()
+		complete.Parts = append(complete.Parts, completedPart{number, resp.Header.Get("ETag")})
+
+		n, err := io.ReadFull(r, part[:cap(part)])
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			s.abortMultipart(key, initiate.UploadID)
+			return nil, size, err
+		}
+		size += int64(n)
+		part = part[:n]
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		s.abortMultipart(key, initiate.UploadID)
+		return nil, size, err
+	}
+
+	commit := func() error {
+		resp, err := s.doHeaders(http.MethodPost, key, url.Values{"uploadId": {initiate.UploadID}}, bytes.NewReader(body), int64(len(body)), headers)
+		if err != nil {
+			s.abortMultipart(key, initiate.UploadID)
+			return conditionFailed(err, headers)
+		}
+		resp.Body.Close()
+		return nil
+	}
+	abort := func() error {
+		s.abortMultipart(key, initiate.UploadID)
+		return nil
+	}
+	return &pending{commit, abort}, size, nil
+}
+
+func (s *S3) abortMultipart(key string, uploadID string) {
+	resp, err := s.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, 0)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// Get opens the file stored for token
+// The returned File issues ranged GET requests, so seeking doesn't download the skipped bytes.
+// They fail if the object is replaced, rather than mixing both versions.
+func (s *S3) Get(token string) (File, error) {
+	key, err := s.key(token)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(http.MethodHead, key, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return &s3Object{s3: s, key: key, size: resp.ContentLength, etag: resp.Header.Get("ETag")}, nil
+}
+
+// Delete removes the file stored for token
+func (s *S3) Delete(token string) error {
+	if _, err := s.Stat(token); err != nil {
+		return err
+	}
+	key, _ := s.key(token)
+	resp, err := s.do(http.MethodDelete, key, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Stat returns information about the file stored for token
+func (s *S3) Stat(token string) (*Info, error) {
+	key, err := s.key(token)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(http.MethodHead, key, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &Info{token, resp.ContentLength, modified, resp.Header.Get("ETag")}, nil
+}
+
+// List returns every stored file
+func (s *S3) List() ([]Info, error) {
+	var result []Info
+	continuation := ""
+	for {
+		query := url.Values{"list-type": {"2"}}
+		if s.config.Prefix != "" {
+			query.Set("prefix", s.config.Prefix)
+		}
+		if continuation != "" {
+			query.Set("continuation-token", continuation)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var list struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+				ETag         string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, each := range list.Contents {
+			token := each.Key[strings.LastIndex(each.Key, "/")+1:]
+			result = append(result, Info{token, each.Size, each.LastModified, each.ETag})
+		}
+		if !list.IsTruncated {
+			return result, nil
+		}
+		continuation = list.NextContinuationToken
+	}
+}
+
+// key returns the object key for a token
+func (s *S3) key(token string) (string, error) {
+	if len(token) < 5 || strings.ContainsAny(token, "/?#%") {
+		return "", errors.New("Invalid token")
+	}
+	return s.config.Prefix + token[0:3] + "/" + token[3:5] + "/" + token, nil
+}
+
+// do sends a signed request for key, an empty key addresses the bucket itself
+// It returns ErrNotFound on 404, ErrModified when an If-Match fails, and an error for any other non 2xx status
+func (s *S3) do(method string, key string, query url.Values, body io.Reader, length int64) (*http.Response, error) {
+	return s.doHeaders(method, key, query, body, length, nil)
+}
+
+func (s *S3) doHeaders(method string, key string, query url.Values, body io.Reader, length int64, headers http.Header) (*http.Response, error) {
+	return s.send(method, key, query, body, length, headers, s.config.Timeout)
+}
+
+// send is doHeaders with a timeout, 0 for none. The response body must be closed to release its context.
+func (s *S3) send(method string, key string, query url.Values, body io.Reader, length int64, headers http.Header,
+	timeout time.Duration) (*http.Response, error) {
+	u := *s.endpoint
+	path := strings.TrimSuffix(u.Path, "/")
+	if s.config.PathStyle {
+		path += "/" + s.config.Bucket
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+	}
+	u.Path = path + "/" + key
+	u.RawQuery = canonicalQuery(query)
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(s.ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(s.ctx)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.ContentLength = length
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	s.sign(req, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelingBody{resp.Body, cancel}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		resp.Body.Close()
+		return nil, ErrModified
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("S3 %s %s: %s %s", method, key, resp.Status, message)
+	}
+	return resp, nil
+}
+
+// cancelingBody releases the context of a request once its response body is closed
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// sign adds an AWS signature version 4 Authorization header to req
+func (s *S3) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	var names []string
+	canonical := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		canonical[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	for name := range canonical {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + canonical[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+
+	scope := date + "/" + s.config.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.config.SecretKey), date)
+	key = hmacSHA256(key, s.config.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.config.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes a query the way AWS signatures expect it: sorted, with %20 for spaces
+func canonicalQuery(query url.Values) string {
+	return strings.Replace(query.Encode(), "+", "%20", -1)
+}
+
+// s3Object is a File reading an S3 object with ranged GETs
+type s3Object struct {
+	s3     *S3
+	key    string
+	size   int64
+	etag   string
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		headers := http.Header{"Range": {"bytes=" + strconv.FormatInt(o.offset, 10) + "-"}}
+		if o.etag != "" {
+			headers.Set("If-Match", o.etag)
+		}
+		resp, err := o.s3.send(http.MethodGet, o.key, nil, nil, 0, headers, 0)
+		if err != nil {
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return o.offset, errors.New("Invalid whence")
+	}
+	if offset < 0 {
+		return o.offset, errors.New("Negative position")
+	}
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
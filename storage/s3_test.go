@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"ezcp.io/ezcp-server/storage/s3test"
+)
+
+func newTestS3(t *testing.T, prefix string) (*S3, *s3test.Server) {
+	server := s3test.NewServer()
+	t.Cleanup(server.Close)
+	s3, err := NewS3(S3Config{
+		Endpoint:  server.URL,
+		Bucket:    "ezcp",
+		Region:    "us-east-1",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PathStyle: true,
+		Prefix:    prefix,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s3, server
+}
+
+func TestS3(t *testing.T) {
+	s3, _ := newTestS3(t, "")
+	testStorage(t, s3)
+}
+
+func TestS3Layout(t *testing.T) {
+	s3, server := newTestS3(t, "files/")
+	if _, err := s3.Put("abcdefgh", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := server.Object("ezcp", "files/abc/de/abcdefgh"); !ok || string(data) != "hello" {
+		t.Errorf("object = %q, %v", data, ok)
+	}
+	if tokens := list(t, s3); len(tokens) != 1 || tokens[0] != "abcdefgh" {
+		t.Errorf("List = %v", tokens)
+	}
+
+	if err := s3.Delete("abcdefgh"); err != nil {
+		t.Fatal(err)
+	}
+	if server.Len() != 0 {
+		t.Errorf("%d objects left after Delete", server.Len())
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	s3, _ := newTestS3(t, "")
+	data := randomData(2*s3PartSize + 1000)
+	n, err := s3.Put("multipart", bytes.NewReader(data))
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("Put = %d, %v", n, err)
+	}
+	checkRanges(t, s3, "multipart", data)
+
+	// a multipart replacement is refused once the object changed
+	previous := stat(t, s3, "multipart")
+	p, _, err := s3.Replace("multipart", bytes.NewReader(data), previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3.Put("multipart", strings.NewReader("uploaded"))
+	if err = p.Commit(); err != ErrModified {
+		t.Errorf("Commit = %v, want ErrModified", err)
+	}
+	checkContent(t, s3, "multipart", "uploaded")
+}
+
+func TestS3Timeout(t *testing.T) {
+	stuck := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stuck
+	}))
+	defer server.Close()
+	defer close(stuck)
+
+	s3, err := NewS3(S3Config{Endpoint: server.URL, Bucket: "ezcp", PathStyle: true, Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err = s3.Stat("abcdefgh"); err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("Stat of an unresponsive S3 = %v after %v", err, time.Since(start))
+	}
+}
+
+func TestS3Context(t *testing.T) {
+	s3, _ := newTestS3(t, "")
+	if _, err := s3.Put("abcdefgh", strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	bound := WithContext(ctx, s3)
+	file, err := bound.Get("abcdefgh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	// the requests stop once the context is done, and the storage itself isn't affected
+	cancel()
+	if _, err = ioutil.ReadAll(file); !errors.Is(err, context.Canceled) {
+		t.Errorf("read with a canceled context = %v", err)
+	}
+	if _, err = bound.Stat("abcdefgh"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Stat with a canceled context = %v", err)
+	}
+	checkContent(t, s3, "abcdefgh", "hello")
+}
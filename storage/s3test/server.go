@@ -0,0 +1,201 @@
+// Package s3test provides a small in-memory S3 compatible server, a stand-in
+// for MinIO when testing the S3 storage backend.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a fake S3 server, it supports path-style addressing only
+type Server struct {
+	*httptest.Server
+
+	mutex   sync.Mutex
+	objects map[string]object         // bucket/key -> object
+	uploads map[string]map[int][]byte // uploadId -> parts
+	nextID  int
+}
+
+type object struct {
+	data     []byte
+	modified time.Time
+}
+
+func (o object) etag() string {
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// precondition checks the If-Match of a write to path, which fails if the object was replaced or deleted
+func (s *Server) precondition(res http.ResponseWriter, req *http.Request, path string) bool {
+	etag := req.Header.Get("If-Match")
+	if etag == "" {
+		return true
+	}
+	obj, ok := s.objects[path]
+	if !ok {
+		res.WriteHeader(http.StatusNotFound)
+		return false
+	}
+	if obj.etag() != etag {
+		res.WriteHeader(http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
+
+// NewServer starts a new fake S3 server, callers should Close it when done
+func NewServer() *Server {
+	s := &Server{
+		objects: make(map[string]object),
+		uploads: make(map[string]map[int][]byte),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Object returns the content of bucket/key and true, or false if not found
+func (s *Server) Object(bucket string, key string) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	obj, ok := s.objects[bucket+"/"+key]
+	return obj.data, ok
+}
+
+// Len returns the number of stored objects
+func (s *Server) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.objects)
+}
+
+func (s *Server) serveHTTP(res http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		res.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	query := req.URL.Query()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !strings.Contains(path, "/") || strings.HasSuffix(path, "/") {
+		s.list(res, strings.TrimSuffix(path, "/"), query.Get("prefix"))
+		return
+	}
+
+	switch {
+	case req.Method == http.MethodPost && hasKey(query, "uploads"):
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(res, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+
+	case req.Method == http.MethodPut && query.Get("uploadId") != "":
+		parts, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			res.WriteHeader(http.StatusNotFound)
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		data, _ := ioutil.ReadAll(req.Body)
+		parts[number] = data
+		sum := md5.Sum(data)
+		res.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+
+	case req.Method == http.MethodPost && query.Get("uploadId") != "":
+		parts, ok := s.uploads[query.Get("uploadId")]
+		if !ok {
+			res.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !s.precondition(res, req, path) {
+			return
+		}
+		var numbers []int
+		for number := range parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		var data bytes.Buffer
+		for _, number := range numbers {
+			data.Write(parts[number])
+		}
+		delete(s.uploads, query.Get("uploadId"))
+		s.objects[path] = object{data.Bytes(), time.Now()}
+		res.Write([]byte("<CompleteMultipartUploadResult></CompleteMultipartUploadResult>"))
+
+	case req.Method == http.MethodDelete && query.Get("uploadId") != "":
+		delete(s.uploads, query.Get("uploadId"))
+		res.WriteHeader(http.StatusNoContent)
+
+	case req.Method == http.MethodPut:
+		data, _ := ioutil.ReadAll(req.Body)
+		if !s.precondition(res, req, path) {
+			return
+		}
+		s.objects[path] = object{data, time.Now()}
+		res.Header().Set("ETag", s.objects[path].etag())
+
+	case req.Method == http.MethodDelete:
+		delete(s.objects, path)
+		res.WriteHeader(http.StatusNoContent)
+
+	case req.Method == http.MethodGet || req.Method == http.MethodHead:
+		obj, ok := s.objects[path]
+		if !ok {
+			res.WriteHeader(http.StatusNotFound)
+			return
+		}
+		res.Header().Set("ETag", obj.etag())
+		http.ServeContent(res, req, path, obj.modified, bytes.NewReader(obj.data))
+
+	default:
+		res.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) list(res http.ResponseWriter, bucket string, prefix string) {
+	type content struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+		ETag         string
+	}
+	var result struct {
+		XMLName     xml.Name `xml:"ListBucketResult"`
+		Contents    []content
+		IsTruncated bool
+	}
+	var keys []string
+	for path := range s.objects {
+		if strings.HasPrefix(path, bucket+"/"+prefix) {
+			keys = append(keys, path)
+		}
+	}
+	sort.Strings(keys)
+	for _, path := range keys {
+		obj := s.objects[path]
+		result.Contents = append(result.Contents, content{strings.TrimPrefix(path, bucket+"/"), int64(len(obj.data)), obj.modified, obj.etag()})
+	}
+	xml.NewEncoder(res).Encode(result)
+}
+
+func hasKey(query map[string][]string, key string) bool {
+	_, ok := query[key]
+	return ok
+}
@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DefaultStagingPath is the default location of partial uploads
+const DefaultStagingPath = "ezcp-staging/"
+
+var (
+	// ErrOffsetMismatch is returned when appending at an offset which isn't the end of the partial upload
+	ErrOffsetMismatch = errors.New("Offset mismatch")
+
+	// ErrBusy is returned when the partial upload is already being appended to
+	ErrBusy = errors.New("Upload in progress")
+)
+
+// Staging keeps partial uploads on the local filesystem until they are complete
+type Staging struct {
+	root string
+
+	mutex sync.Mutex
+	busy  map[string]bool
+}
+
+// NewStaging returns a new Staging area rooted at path
+func NewStaging(path string) *Staging {
+	return &Staging{root: path, busy: make(map[string]bool)}
+}
+
+// Create starts a new empty partial upload for token, discarding any previous one.
+// It returns ErrBusy if the partial upload is being appended to.
+func (s *Staging) Create(token string) error {
+	partial, err := s.CreateWriter(token)
+	if err != nil {
+		return err
+	}
+	return partial.Close()
+}
+
+// Offset returns the current size of the partial upload for token
+func (s *Staging) Offset(token string) (int64, error) {
+	path, err := s.path(token)
+	if err != nil {
+		return 0, err
+	}
+	fileinfo, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return fileinfo.Size(), nil
+}
+
+// Writer opens the partial upload for token, which must be offset bytes long, for appending.
+// No other request can create, append to or remove it until the Partial is closed.
+func (s *Staging) Writer(token string, offset int64) (*Partial, error) {
+	return s.open(token, os.O_WRONLY|os.O_APPEND, offset)
+}
+
+// CreateWriter starts a new empty partial upload for token, discarding any previous one,
+// and opens it for appending like Writer. It returns ErrBusy if the partial upload is being appended to.
+func (s *Staging) CreateWriter(token string) (*Partial, error) {
+	if err := os.MkdirAll(s.root, 0700); err != nil {
+		return nil, err
+	}
+	return s.open(token, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0)
+}
+
+func (s *Staging) open(token string, flag int, offset int64) (*Partial, error) {
+	path, err := s.path(token)
+	if err != nil {
+		return nil, err
+	}
+	if !s.lock(token) {
+		return nil, ErrBusy
+	}
+
+	file, err := os.OpenFile(path, flag, 0600)
+	if os.IsNotExist(err) {
+		s.unlock(token)
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		s.unlock(token)
+		return nil, err
+	}
+
+	fileinfo, err := file.Stat()
+	if err == nil && fileinfo.Size() != offset {
+		err = ErrOffsetMismatch
+	}
+	if err != nil {
+		file.Close()
+		s.unlock(token)
+		return nil, err
+	}
+	return &Partial{file, path, func() { s.unlock(token) }}, nil
+}
+
+// Partial is a partial upload opened for appending.
+// It stays locked until closed, so it can be completed before another request touches it.
+type Partial struct {
+	file   *os.File
+	path   string
+	unlock func()
+}
+
+func (p *Partial) Write(data []byte) (int, error) {
+	return p.file.Write(data)
+}
+
+// Truncate discards what was appended after size bytes
+func (p *Partial) Truncate(size int64) error {
+	return p.file.Truncate(size)
+}
+
+// Close closes the partial upload and keeps it, so it can be resumed
+func (p *Partial) Close() error {
+	defer p.unlock()
+	return p.file.Close()
+}
+
+// Discard closes and removes the partial upload, once it is complete or failed
+func (p *Partial) Discard() error {
+	defer p.unlock()
+	p.file.Close()
+	return os.Remove(p.path)
+}
+
+// Open opens the partial upload for token
+func (s *Staging) Open(token string) (File, error) {
+	path, err := s.path(token)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// MoveTo moves the complete upload for token to the storage m, see Mover.PrepareFile.
+// The caller holds the partial upload, and discards it once committed.
+func (s *Staging) MoveTo(m Mover, token string) (Pending, int64, error) {
+	path, err := s.path(token)
+	if err != nil {
+		return nil, 0, err
+	}
+	return m.PrepareFile(token, path)
+}
+
+// Remove discards the partial upload for token, it returns ErrBusy if it is being appended to
+func (s *Staging) Remove(token string) error {
+	path, err := s.path(token)
+	if err != nil {
+		return err
+	}
+	if !s.lock(token) {
+		return ErrBusy
+	}
+	defer s.unlock(token)
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// FreeSpace returns the bytes available on the filesystem of the partial uploads
+func (s *Staging) FreeSpace() (uint64, error) {
+	return FreeSpace(s.root)
+}
+
+// Filesystem identifies the filesystem of the partial uploads
+func (s *Staging) Filesystem() (string, error) {
+	return Filesystem(s.root)
+}
+
+// List returns every partial upload
+func (s *Staging) List() ([]Info, error) {
+	files, err := ioutil.ReadDir(s.root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result []Info
+	for _, fileinfo := range files {
+		if !fileinfo.IsDir() {
+			result = append(result, Info{fileinfo.Name(), fileinfo.Size(), fileinfo.ModTime(), ""})
+		}
+	}
+	return result, nil
+}
+
+func (s *Staging) lock(token string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.busy[token] {
+		return false
+	}
+	s.busy[token] = true
+	return true
+}
+
+func (s *Staging) unlock(token string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.busy, token)
+}
+
+func (s *Staging) path(token string) (string, error) {
+	if token == "" || filepath.Base(token) != token {
+		return "", errors.New("Invalid token")
+	}
+	return filepath.Join(s.root, token), nil
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when no file is stored for a token
+	ErrNotFound = errors.New("File not found")
+
+	// ErrModified is returned when the file to replace was replaced or deleted in the meantime
+	ErrModified = errors.New("File modified")
+)
+
+// Storage stores the files uploaded to tokens
+type Storage interface {
+	// Put stores the content of r for token, replacing any previous file,
+	// and returns the number of bytes written
+	Put(token string, r io.Reader) (int64, error)
+
+	// Prepare writes the content of r for token, and returns the number of bytes written.
+	// The previous file is only replaced when the returned Pending is committed.
+	Prepare(token string, r io.Reader) (Pending, int64, error)
+
+	// Replace writes the content of r for token like Prepare, to replace the file described by previous.
+	// Commit returns ErrModified, and keeps the stored file, if it isn't previous anymore.
+	Replace(token string, r io.Reader, previous *Info) (Pending, int64, error)
+
+	// Get opens the file stored for token, or returns ErrNotFound
+	Get(token string) (File, error)
+
+	// Delete removes the file stored for token, or returns ErrNotFound
+	Delete(token string) error
+
+	// Stat returns information about the file stored for token, or returns ErrNotFound
+	Stat(token string) (*Info, error)
+
+	// List returns information about every stored file
+	List() ([]Info, error)
+}
+
+// Disk is a storage on a local filesystem, which reports its free space
+type Disk interface {
+	// FreeSpace returns the bytes available on the filesystem
+	FreeSpace() (uint64, error)
+
+	// Filesystem identifies the filesystem, storages on the same one have the same ID
+	Filesystem() (string, error)
+}
+
+// Mover is a storage which can take a local file over instead of copying it
+type Mover interface {
+	// PrepareFile moves the file at path, which mustn't be written anymore, to the file of token like Prepare.
+	// Abort moves it back. It is copied if it can't be moved, from another filesystem.
+	PrepareFile(token string, path string) (Pending, int64, error)
+}
+
+// Contextual is a storage making requests, which can be bound to a context
+type Contextual interface {
+	// WithContext returns the storage making its requests with ctx, they are canceled when it is done
+	WithContext(ctx context.Context) Storage
+}
+
+// WithContext returns s making its requests with ctx, or s if it doesn't make requests
+func WithContext(ctx context.Context, s Storage) Storage {
+	switch each := s.(type) {
+	case *Encrypted:
+		return &Encrypted{WithContext(ctx, each.inner), each.keyring, each.plaintext}
+	case Contextual:
+		return each.WithContext(ctx)
+	}
+	return s
+}
+
+// DiskOf returns the Disk of s, or nil if s isn't stored on a local filesystem
+func DiskOf(s Storage) Disk {
+	switch each := s.(type) {
+	case *Encrypted:
+		return DiskOf(each.inner)
+	case Disk:
+		return each
+	}
+	return nil
+}
+
+// Pending is a file written by Prepare
+type Pending interface {
+	// Commit replaces the file of the token atomically, readers get either the old file or the new one
+	Commit() error
+
+	// Abort discards the file
+	Abort() error
+}
+
+// pending is a Pending made of functions
+type pending struct {
+	commit func() error
+	abort  func() error
+}
+
+func (p *pending) Commit() error {
+	return p.commit()
+}
+
+func (p *pending) Abort() error {
+	return p.abort()
+}
+
+// put implements Put with Prepare
+func put(s Storage, token string, r io.Reader) (int64, error) {
+	p, n, err := s.Prepare(token, r)
+	if err != nil {
+		return n, err
+	}
+	return n, p.Commit()
+}
+
+// File is a stored file opened for reading
+type File interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// Info describes a stored file
+type Info struct {
+	Token    string
+	Size     int64
+	Modified time.Time
+	Version  string // identifies the content, where the storage tells it apart from Size and Modified
+}
+
+// same returns whether current is still the file described by previous
+func (previous *Info) same(current *Info) bool {
+	return current.Size == previous.Size && current.Modified.Equal(previous.Modified) && current.Version == previous.Version
+}
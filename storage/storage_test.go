@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testStorage checks s behaves like every Storage, it must be empty
+func testStorage(t *testing.T, s Storage) {
+	t.Run("PutGet", func(t *testing.T) {
+		n, err := s.Put("putget00", strings.NewReader("hello"))
+		if err != nil || n != 5 {
+			t.Fatalf("Put = %d, %v", n, err)
+		}
+		checkContent(t, s, "putget00", "hello")
+
+		// Put replaces the previous file
+		if _, err = s.Put("putget00", strings.NewReader("bye")); err != nil {
+			t.Fatal(err)
+		}
+		checkContent(t, s, "putget00", "bye")
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		if _, err := s.Put("empty000", strings.NewReader("")); err != nil {
+			t.Fatal(err)
+		}
+		checkContent(t, s, "empty000", "")
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		if _, err := s.Get("missing0"); err != ErrNotFound {
+			t.Errorf("Get = %v, want ErrNotFound", err)
+		}
+		if _, err := s.Stat("missing0"); err != ErrNotFound {
+			t.Errorf("Stat = %v, want ErrNotFound", err)
+		}
+		if err := s.Delete("missing0"); err != ErrNotFound {
+			t.Errorf("Delete = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		s.Put("delete00", strings.NewReader("hello"))
+		if err := s.Delete("delete00"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Get("delete00"); err != ErrNotFound {
+			t.Errorf("Get after Delete = %v, want ErrNotFound", err)
+		}
+		if err := s.Delete("delete00"); err != ErrNotFound {
+			t.Errorf("second Delete = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("Stat", func(t *testing.T) {
+		s.Put("stat0000", strings.NewReader("hello"))
+		info, err := s.Stat("stat0000")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Token != "stat0000" || info.Size != 5 || info.Modified.IsZero() {
+			t.Errorf("Stat = %+v", info)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		files, err := s.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes := make(map[string]int64)
+		for _, each := range files {
+			sizes[each.Token] = each.Size
+		}
+		want := map[string]int64{"putget00": 3, "empty000": 0, "stat0000": 5}
+		for token, size := range want {
+			if got, ok := sizes[token]; !ok || got != size {
+				t.Errorf("List has %s of %d bytes (%v), want %d", token, got, ok, size)
+			}
+		}
+		if _, ok := sizes["delete00"]; ok {
+			t.Error("List has a deleted file")
+		}
+	})
+
+	t.Run("Commit", func(t *testing.T) {
+		s.Put("commit00", strings.NewReader("old"))
+		p, n, err := s.Prepare("commit00", strings.NewReader("new content"))
+		if err != nil || n != 11 {
+			t.Fatalf("Prepare = %d, %v", n, err)
+		}
+		// the previous file is kept until committed
+		checkContent(t, s, "commit00", "old")
+		if err = p.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		checkContent(t, s, "commit00", "new content")
+	})
+
+	t.Run("Abort", func(t *testing.T) {
+		s.Put("abort000", strings.NewReader("old"))
+		p, _, err := s.Prepare("abort000", strings.NewReader("new"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = p.Abort(); err != nil {
+			t.Fatal(err)
+		}
+		checkContent(t, s, "abort000", "old")
+
+		p, _, err = s.Prepare("abort001", strings.NewReader("new"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Abort()
+		if _, err = s.Stat("abort001"); err != ErrNotFound {
+			t.Errorf("Stat of an aborted file = %v, want ErrNotFound", err)
+		}
+		for _, each := range list(t, s) {
+			if each == "abort001" {
+				t.Error("List has an aborted file")
+			}
+		}
+	})
+
+	t.Run("Replace", func(t *testing.T) {
+		s.Put("replace0", strings.NewReader("old"))
+		previous := stat(t, s, "replace0")
+		p, _, err := s.Replace("replace0", strings.NewReader("new"), previous)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = p.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		checkContent(t, s, "replace0", "new")
+
+		// replaced in the meantime
+		previous = stat(t, s, "replace0")
+		p, _, err = s.Replace("replace0", strings.NewReader("rotated"), previous)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Put("replace0", strings.NewReader("uploaded"))
+		if err = p.Commit(); err != ErrModified {
+			t.Errorf("Commit = %v, want ErrModified", err)
+		}
+		checkContent(t, s, "replace0", "uploaded")
+
+		// deleted in the meantime
+		previous = stat(t, s, "replace0")
+		p, _, err = s.Replace("replace0", strings.NewReader("rotated"), previous)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Delete("replace0")
+		if err = p.Commit(); err != ErrModified {
+			t.Errorf("Commit = %v, want ErrModified", err)
+		}
+		if _, err = s.Stat("replace0"); err != ErrNotFound {
+			t.Errorf("Stat of a deleted file = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("Range", func(t *testing.T) {
+		data := randomData(100000)
+		s.Put("range000", bytes.NewReader(data))
+		checkRanges(t, s, "range000", data)
+	})
+}
+
+func checkContent(t *testing.T, s Storage, token string, want string) {
+	t.Helper()
+	file, err := s.Get(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Errorf("%s contains %q, want %q", token, data, want)
+	}
+}
+
+// checkRanges reads ranges of the file stored for token at random offsets, like Range downloads
+func checkRanges(t *testing.T, s Storage, token string, data []byte) {
+	t.Helper()
+	file, err := s.Get(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil || size != int64(len(data)) {
+		t.Fatalf("Seek to the end = %d, %v, want %d", size, err, len(data))
+	}
+
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 50; i++ {
+		start := random.Int63n(size + 1)
+		length := random.Int63n(size - start + 1)
+		if _, err = file.Seek(start, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		part := make([]byte, length)
+		if _, err = io.ReadFull(file, part); err != nil {
+			t.Fatalf("reading %d bytes at %d: %v", length, start, err)
+		}
+		if !bytes.Equal(part, data[start:start+length]) {
+			t.Fatalf("%d bytes at %d differ", length, start)
+		}
+	}
+
+	// reading past the end
+	if _, err = file.Seek(size, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := file.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Errorf("Read at the end = %d, %v, want io.EOF", n, err)
+	}
+}
+
+func stat(t *testing.T, s Storage, token string) *Info {
+	t.Helper()
+	info, err := s.Stat(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func list(t *testing.T, s Storage) []string {
+	t.Helper()
+	files, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tokens []string
+	for _, each := range files {
+		tokens = append(tokens, each.Token)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(data)
+	return data
+}
+
+func TestLocal(t *testing.T) {
+	testStorage(t, NewLocal(t.TempDir()))
+}
+
+func TestLocalInvalidToken(t *testing.T) {
+	local := NewLocal(t.TempDir())
+	for _, token := range []string{"abc", "../../etc", "abc/defgh"} {
+		if _, err := local.Put(token, strings.NewReader("x")); err == nil {
+			t.Errorf("Put accepted token %q", token)
+		}
+	}
+}
+
+func TestLocalPrepareFile(t *testing.T) {
+	local := NewLocal(t.TempDir())
+	local.Put("moved000", strings.NewReader("previous"))
+	source := filepath.Join(t.TempDir(), "upload")
+	ioutil.WriteFile(source, []byte("uploaded"), 0600)
+
+	// aborted, the file is moved back
+	p, n, err := local.PrepareFile("moved000", source)
+	if err != nil || n != 8 {
+		t.Fatalf("PrepareFile = %d, %v", n, err)
+	}
+	if _, err = os.Stat(source); !os.IsNotExist(err) {
+		t.Errorf("the file was copied: %v", err)
+	}
+	checkContent(t, local, "moved000", "previous")
+	if err = p.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(source); err != nil || string(data) != "uploaded" {
+		t.Fatalf("after Abort, the file is %q, %v", data, err)
+	}
+
+	p, _, err = local.PrepareFile("moved000", source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, local, "moved000", "uploaded")
+	if tokens := list(t, local); len(tokens) != 1 {
+		t.Errorf("List = %v", tokens)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	testStorage(t, NewMemory())
+}
@@ -0,0 +1,138 @@
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// maxAttempts is how many tokens are generated before giving up on collisions
+const maxAttempts = 10
+
+// Formats are the supported token formats
+var Formats = []string{"hex", "base32", "words"}
+
+// Generator generates random tokens
+type Generator interface {
+	Generate() (string, error)
+}
+
+// NewGenerator returns a Generator for format, one of Formats
+func NewGenerator(format string) (Generator, error) {
+	switch format {
+	case "hex":
+		return hexGenerator{}, nil
+	case "base32":
+		return base32Generator{}, nil
+	case "words":
+		return wordsGenerator{}, nil
+	}
+	return nil, errors.New("Unknown token format " + format)
+}
+
+// Durable returns the generator of permanent tokens, which are kept for months:
+// words tokens are too easy to guess, hex ones are used instead
+func Durable(generator Generator) Generator {
+	if _, ok := generator.(wordsGenerator); ok {
+		return hexGenerator{}
+	}
+	return generator
+}
+
+// New generates a token for which exists returns false
+func New(generator Generator, exists func(token string) (bool, error)) (string, error) {
+	for i := 0; i < maxAttempts; i++ {
+		token, err := generator.Generate()
+		if err != nil {
+			return "", err
+		}
+		found, err := exists(token)
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			return token, nil
+		}
+	}
+	return "", fmt.Errorf("No unique token after %d attempts", maxAttempts)
+}
+
+// Secret returns a random 160 bits secret in hexadecimal
+func Secret() (string, error) {
+	return hexGenerator{}.Generate()
+}
+
+// Shard returns the hexadecimal digit used to pick the server of a token.
+// It is the first character of hex tokens, so existing tokens keep their server.
+func Shard(token string) byte {
+	if len(token) == 40 && isHex(token) {
+		return token[0]
+	}
+	sum := sha1.Sum([]byte(token))
+	return hex.EncodeToString(sum[:1])[0]
+}
+
+func isHex(s string) bool {
+	return strings.Trim(s, "0123456789abcdef") == ""
+}
+
+// hexGenerator generates 160 bits tokens in hexadecimal, e.g. 9c1185a5c5e9fc54612808977ee8f548b2258d31
+type hexGenerator struct{}
+
+func (hexGenerator) Generate() (string, error) {
+	bytes, err := random(20)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// base32Generator generates 160 bits tokens in lowercase base32, e.g. tqiylji4ntvikrqiegxv5jhvjczcldjr
+type base32Generator struct{}
+
+func (base32Generator) Generate() (string, error) {
+	bytes, err := random(20)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(base32.StdEncoding.EncodeToString(bytes)), nil
+}
+
+// wordsGenerator generates short human readable tokens, e.g. maple-otter-42.
+// They have about 20 bits of entropy, enough for transient tokens, see Durable.
+type wordsGenerator struct{}
+
+func (wordsGenerator) Generate() (string, error) {
+	first, err := randomInt(len(firstWords))
+	if err != nil {
+		return "", err
+	}
+	second, err := randomInt(len(secondWords))
+	if err != nil {
+		return "", err
+	}
+	number, err := randomInt(90)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s-%d", firstWords[first], secondWords[second], number+10), nil
+}
+
+func random(n int) ([]byte, error) {
+	bytes := make([]byte, n)
+	_, err := rand.Read(bytes)
+	return bytes, err
+}
+
+func randomInt(max int) (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return 0, err
+	}
+	return int(n.Int64()), nil
+}
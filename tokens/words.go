@@ -0,0 +1,40 @@
+package tokens
+
+// firstWords and secondWords are used by the words format
+var firstWords = []string{
+	"acorn", "alder", "amber", "apple", "aspen", "autumn", "azure", "basil",
+	"bay", "birch", "bitter", "black", "blue", "bold", "brave", "breezy",
+	"bright", "brisk", "bronze", "calm", "cedar", "cherry", "chilly", "clever",
+	"cloudy", "cobalt", "copper", "coral", "cosmic", "crimson", "crisp", "curly",
+	"daisy", "dawn", "desert", "dusty", "eager", "early", "ebony", "elder",
+	"ember", "fancy", "fern", "fiery", "frosty", "fuzzy", "gentle", "ginger",
+	"glad", "golden", "grand", "green", "hazel", "holly", "honey", "humble",
+	"icy", "indigo", "ivory", "jade", "jolly", "juniper", "keen", "kind",
+	"lemon", "lilac", "lively", "lucky", "lunar", "maple", "marble", "meadow",
+	"mellow", "merry", "mighty", "minty", "misty", "mossy", "nimble", "noble",
+	"oak", "ocean", "olive", "orange", "pearl", "pepper", "pine", "plum",
+	"polar", "proud", "quick", "quiet", "rainy", "rapid", "red", "river",
+	"rocky", "rosy", "ruby", "rusty", "sage", "salty", "sandy", "scarlet",
+	"shady", "shiny", "silent", "silver", "sleepy", "snowy", "solar", "spicy",
+	"spring", "stormy", "sunny", "swift", "tawny", "teal", "tidy", "topaz",
+	"velvet", "violet", "warm", "wild", "willow", "windy", "winter", "witty",
+}
+
+var secondWords = []string{
+	"badger", "bat", "bear", "beaver", "bee", "bison", "boar", "bobcat",
+	"camel", "cat", "cheetah", "cobra", "condor", "cougar", "coyote", "crab",
+	"crane", "crow", "deer", "dingo", "dolphin", "dove", "duck", "eagle",
+	"eel", "egret", "elk", "emu", "falcon", "ferret", "finch", "fox",
+	"frog", "gazelle", "gecko", "goat", "goose", "gopher", "gull", "hare",
+	"hawk", "hedgehog", "heron", "hippo", "horse", "hyena", "ibis", "iguana",
+	"impala", "jackal", "jaguar", "jay", "kestrel", "kiwi", "koala", "lark",
+	"lemur", "leopard", "lion", "lizard", "llama", "lobster", "lynx", "magpie",
+	"mole", "moose", "moth", "mouse", "mule", "newt", "ocelot", "octopus",
+	"orca", "osprey", "otter", "owl", "ox", "panda", "panther", "parrot",
+	"pelican", "penguin", "pigeon", "puffin", "puma", "quail", "rabbit", "raccoon",
+	"raven", "robin", "salmon", "seal", "shark", "sheep", "shrew", "skunk",
+	"sloth", "snail", "sparrow", "spider", "squid", "stork", "swan", "tapir",
+	"tiger", "toad", "trout", "turkey", "turtle", "viper", "vole", "walrus",
+	"wasp", "weasel", "whale", "wolf", "wombat", "wren", "yak", "zebra",
+	"beetle", "marten", "mink", "oriole", "pika", "plover", "sable", "tern",
+}